@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+)
+
+// A FeedArchive keeps the raw feed documents a Fetch downloads.
+type FeedArchive interface {
+	Put(url string, fetched time.Time, data []byte) error
+	Feeds() FeedIter
+}
+
+type FeedIter interface {
+	Next(feed *ArchivedFeed) bool
+	Err() error
+	Close() error
+}
+
+// ArchivedFeed is a compressed feed document. Identical documents of a url
+// are stored once, Fetched lists every time one was downloaded. Source is only set in
+// a database shared by several sources.
+type ArchivedFeed struct {
+	Hash    string
+	Source  string
+	Url     string
+	Fetched []time.Time
+	Data    []byte
+}
+
+// key identifies the document of feed, identical documents from different
+// urls are kept apart.
+func (feed *ArchivedFeed) key() string {
+	return feed.Url + " " + feed.Hash
+}
+
+func NewArchivedFeed(url string, fetched time.Time, data []byte) (*ArchivedFeed, error) {
+	var buffer = new(bytes.Buffer)
+	var writer, _ = flate.NewWriter(buffer, flate.BestCompression)
+
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	var h = sha1.New()
+	h.Write(data)
+
+	return &ArchivedFeed{
+		Hash:    hex.EncodeToString(h.Sum(nil)),
+		Url:     url,
+		Fetched: []time.Time{fetched},
+		Data:    buffer.Bytes(),
+	}, nil
+}
+
+func (f *ArchivedFeed) Feed() io.ReadCloser {
+	return flate.NewReader(bytes.NewReader(f.Data))
+}
+
+// DatabaseArchive stores feeds in the feeds collection of a database. If
+// source is set, the collection is shared by several sources.
+type DatabaseArchive struct {
+	database string
+	source   string
+}
+
+func NewDatabaseArchive(database, source string) *DatabaseArchive {
+	return &DatabaseArchive{database, source}
+}
+
+func (a *DatabaseArchive) Put(url string, fetched time.Time, data []byte) error {
+	var feed, err = NewArchivedFeed(url, fetched, data)
+
+	if err != nil {
+		return err
+	}
+
+	feed.Source = a.source
+
+	return ArchiveFeed(a.database, feed)
+}
+
+func (a *DatabaseArchive) Feeds() FeedIter {
+	return ArchivedFeeds(a.database, a.source)
+}
+
+// replay converts the archived feeds of a source to articles again, using
+// the same conversion as Fetch.
+func replay(args []string) {
+	var flags = flag.NewFlagSet("replay", flag.ExitOnError)
+	var size = flags.Int("batch", batchSize, "number of articles written per batch")
+	var out = flags.String("out", "", "append articles to this JSON lines file instead of the database")
+
+	flags.Parse(args)
+
+	for _, name := range flags.Args() {
+		var chooser, err = ParseLinkChooser(config.Source(name).Links)
+
+		if err != nil {
+			log.Fatal(name, ": ", err)
+		}
+
+		var sink ArticleSink
+
+		if *out != "" {
+			sink, err = OpenJsonSink(*out)
+		} else {
+			sink, err = openDatabaseSink(name, *size, time.Minute)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		scope, err := SourceScope(name)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var fetch = NewFetch(nil, chooser, sink)
+		fetch.Scope = scope
+
+		archive, err := OpenArchive(name)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var iter = archive.Feeds()
+		var feeds, articles = 0, 0
+
+		for feed := new(ArchivedFeed); iter.Next(feed); feed = new(ArchivedFeed) {
+			var reader = feed.Feed()
+			var data, err = ioutil.ReadAll(reader)
+
+			reader.Close()
+			feeds++
+
+			if err != nil {
+				log.Println("Error reading", feed.Url, feed.Hash, err)
+				continue
+			}
+
+			items, _, err := ParseFeedData(data)
+
+			if err != nil {
+				log.Println("Error parsing", feed.Url, feed.Hash, err)
+				continue
+			}
+
+			articles += fetch.store(items)
+		}
+
+		if err := iter.Err(); err != nil {
+			log.Fatal(err)
+		}
+
+		iter.Close()
+
+		if err := sink.Close(); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("Replayed", feeds, "feeds with", articles, "articles of", name)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"compress/flate"
 	"compress/zlib"
 	"encoding/base64"
 	"errors"
@@ -11,48 +10,114 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 )
 
 var (
-	ErrNoData  = errors.New("No Data stored in SiteData")
-	ErrNoToken = errors.New("Not on a start tag")
+	ErrNoData    = errors.New("No Data stored in SiteData")
+	ErrNoWebsite = errors.New("No website stored")
+	ErrNoToken   = errors.New("Not on a start tag")
 )
 
+// Article is a stored article. Source is the newspaper, it is only stored
+// in databases shared by several of them. Section is the first path segment
+// of the link, FirstSeen the time it was first stored and Schema the
+// version of its format, see migrations.
 type Article struct {
 	Id         string
 	Title      string
 	Summary    string
 	PubDate    time.Time "pubDate"
 	Link       string
+	Kind       Kind
+	Source     string
+	Section    string
+	FirstSeen  time.Time "firstSeen"
+	Media      []Media
+	Categories []string
+	Authors    []string
 	WebsiteRaw []byte
-	SiteData   *struct {
+	// WebsiteHash is the hash of the page in the blob store, it is only set
+	// without WebsiteRaw.
+	WebsiteHash string "websiteHash,omitempty"
+	SiteData    *struct {
 		Data       []byte
 		Compressed bool
 	} "site"
+	// Text is the text of the page once it moved to the cold archive, Cold
+	// locates it there.
+	Text string    "text,omitempty"
+	Cold *ColdPage "cold,omitempty"
+	// Quarantine lists the problems verify found, quarantined articles are
+	// left out of queries.
+	Quarantine string "quarantine,omitempty"
+	// FromSite is set if the schema migration moved the page out of
+	// SiteData, only those pages go back there when it is rolled back.
+	FromSite bool "fromSite,omitempty"
+	Schema   int
 }
 
-func (a *Article) Website() io.ReadCloser {
+// Media is an image, video or audio file attached to an article by its feed.
+type Media struct {
+	Url     string
+	Type    string
+	Size    int64
+	Caption string
+}
+
+// Website returns the page of the article, from the blob store or the cold
+// archive if it was moved there, ErrNoWebsite if there is none.
+func (a *Article) Website() (io.ReadCloser, error) {
 	if a.WebsiteRaw != nil {
-		return flate.NewReader(bytes.NewReader(a.WebsiteRaw))
+		return Decompress(a.WebsiteRaw)
 	}
 
-	return nil
+	if a.WebsiteHash == "" {
+		if a.Cold != nil {
+			return LoadColdPage(a.Cold)
+		}
+
+		return nil, ErrNoWebsite
+	}
+
+	var data, err = LoadBlob(a.WebsiteHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return Decompress(data)
 }
 
+// SetWebsite stores a page compressed without a dictionary.
 func (a *Article) SetWebsite(reader io.Reader) error {
-	buffer := new(bytes.Buffer)
-	writer, _ := flate.NewWriter(buffer, flate.BestCompression)
+	return a.CompressWebsite(reader, nil)
+}
+
+// CompressWebsite stores a page compressed with dict, see Compress.
+func (a *Article) CompressWebsite(reader io.Reader, dict *Dictionary) error {
+	var data, err = Compress(reader, dict)
 
-	if _, err := io.Copy(writer, reader); err != nil {
+	if err != nil {
 		return err
 	}
 
-	if err := writer.Close(); err != nil {
+	a.WebsiteRaw = data
+
+	return nil
+}
+
+// SetExtracted stores the text compact extracted from the page in
+// WebsiteRaw, see CompressText.
+func (a *Article) SetExtracted(text io.Reader) error {
+	var data, err = CompressText(text)
+
+	if err != nil {
 		return err
 	}
 
-	a.WebsiteRaw = buffer.Bytes()
+	a.WebsiteRaw = data
 
 	return nil
 }
@@ -70,6 +135,38 @@ func (a *Article) Site() (io.ReadCloser, error) {
 	return ioutil.NopCloser(bytes.NewReader(a.SiteData.Data)), nil
 }
 
+// PageText returns the text of an html page without scripts and styles,
+// with runs of whitespace collapsed to a single space.
+func PageText(reader io.Reader) (string, error) {
+	var data, err = ioutil.ReadAll(reader)
+
+	if err != nil {
+		return "", err
+	}
+
+	root, err := html.Parse(bytes.NewReader(data))
+
+	if err != nil {
+		return "", err
+	}
+
+	var r = toNode(root)
+
+	defer r.Dispose()
+
+	var words []string
+
+	for _, t := range r.descendants(Type(html.TextNode)) {
+		if p := t.Parent; p != nil && (p.Data == "script" || p.Data == "style") {
+			continue
+		}
+
+		words = append(words, strings.Fields(t.Data)...)
+	}
+
+	return strings.Join(words, " "), nil
+}
+
 func (a *Article) DownloadWebsite() (io.ReadCloser, error) {
 	var response, err = http.Get(a.Link)
 
@@ -171,6 +268,27 @@ func (n *node) Dispose() {
 	n.Child = nil
 }
 
+// Text returns the concatenated text of n and its descendants.
+func (n *node) Text() string {
+	var buffer = new(bytes.Buffer)
+
+	for _, t := range n.descendants(Type(html.TextNode)) {
+		buffer.WriteString(t.Data)
+	}
+
+	return buffer.String()
+}
+
+func (n *node) attribute(key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+
+	return "", false
+}
+
 type predicate func(n *node) bool
 
 func Id(id string) predicate {
@@ -185,6 +303,12 @@ func Tag(tag string) predicate {
 	}
 }
 
+func Type(t html.NodeType) predicate {
+	return func(n *node) bool {
+		return n.Type == t
+	}
+}
+
 func Class(class string) predicate {
 	return func(n *node) bool {
 		return n.hasAttribute("class", class)
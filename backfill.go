@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"exp/html"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backfill walks the archive pages of a source and stores the articles they
+// link to that are not known yet.
+type Backfill struct {
+	Store   ArticleStore
+	Pages   []string
+	Pattern *regexp.Regexp
+	// Scope, if set, has to classify the links as articles.
+	Scope *Scope
+	// Links dated before Since are skipped. Paging stops at the first page
+	// whose dated links are all older.
+	Since time.Time
+	Depth int
+	Sink  ArticleSink
+}
+
+func NewBackfill(store ArticleStore, c *BackfillConfig, sink ArticleSink) (*Backfill, error) {
+	if len(c.Pages) == 0 {
+		return nil, errors.New("No backfill pages configured")
+	}
+
+	var pattern, err = regexp.Compile(c.Pattern)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var b = &Backfill{
+		Store:   store,
+		Pages:   c.Pages,
+		Pattern: pattern,
+		Depth:   c.Depth,
+		Sink:    sink,
+	}
+
+	if b.Depth <= 0 {
+		b.Depth = 1
+	}
+
+	return b, nil
+}
+
+// Run walks all pages and returns the number of articles stored.
+func (b *Backfill) Run() (int, error) {
+	var stored = 0
+
+	for _, page := range b.Pages {
+		var next = page
+		var numbered = strings.Contains(page, "{page}")
+
+		for depth := 1; depth <= b.Depth; depth++ {
+			if numbered {
+				next = strings.Replace(page, "{page}", strconv.Itoa(depth), -1)
+			}
+
+			if next == "" {
+				break
+			}
+
+			log.Println("Backfilling", next)
+
+			var articles, nextPage, old, err = b.page(next)
+
+			if err != nil {
+				return stored, err
+			}
+
+			n, err := b.store(articles)
+			stored += n
+
+			if err != nil {
+				return stored, err
+			}
+
+			if old {
+				break
+			}
+
+			next = nextPage
+		}
+	}
+
+	return stored, nil
+}
+
+// page extracts the article links of one archive page. old is set if the
+// page had dated links and all of them are older than b.Since.
+func (b *Backfill) page(pageUrl string) (articles []*Article, next string, old bool, err error) {
+	base, err := url.Parse(pageUrl)
+
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	response, err := http.Get(pageUrl)
+
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, "", false, errors.New(pageUrl + ": " + response.Status)
+	}
+
+	// The tokenizer drops data returned together with io.EOF, which the
+	// body reader does, so the page is read completely first.
+	body, err := ioutil.ReadAll(response.Body)
+
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	root, err := html.Parse(bytes.NewReader(body))
+
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	var r = toNode(root)
+	defer r.Dispose()
+
+	var seen = make(map[string]bool)
+	var dated, recent = 0, 0
+
+	for _, a := range r.descendants(isLink) {
+		var href, _ = a.attribute("href")
+		var ref, err = base.Parse(href)
+
+		if err != nil {
+			continue
+		}
+
+		ref.Fragment = ""
+		var link = ref.String()
+
+		if rel, _ := a.attribute("rel"); rel == "next" {
+			next = link
+			continue
+		}
+
+		var match = b.Pattern.FindStringSubmatch(link)
+
+		if match == nil || seen[link] {
+			continue
+		}
+
+		if b.Scope != nil && !b.Scope.Is(link, KindArticle) {
+			continue
+		}
+
+		seen[link] = true
+
+		var pubDate = b.date(match)
+
+		if !pubDate.IsZero() {
+			dated++
+
+			if pubDate.Before(b.Since) {
+				continue
+			}
+
+			recent++
+		}
+
+		h := md5.New()
+		io.WriteString(h, link)
+
+		articles = append(articles, &Article{
+			Id:      string(h.Sum(nil)),
+			Title:   strings.TrimSpace(a.Text()),
+			Link:    link,
+			Section: LinkSection(link),
+			Kind:    KindArticle,
+			PubDate: pubDate,
+		})
+	}
+
+	return articles, next, dated > 0 && recent == 0, nil
+}
+
+// date reads the year, month and day groups of a pattern match.
+func (b *Backfill) date(match []string) time.Time {
+	var parts = map[string]int{"year": 0, "month": 1, "day": 1}
+	var found = false
+
+	for i, name := range b.Pattern.SubexpNames() {
+		if _, ok := parts[name]; ok {
+			var value, err = strconv.Atoi(match[i])
+
+			if err != nil {
+				return time.Time{}
+			}
+
+			parts[name] = value
+			found = true
+		}
+	}
+
+	if !found || parts["year"] == 0 {
+		return time.Time{}
+	}
+
+	return time.Date(parts["year"], time.Month(parts["month"]), parts["day"], 0, 0, 0, 0, time.UTC)
+}
+
+// store passes the articles with unknown ids to the sink.
+func (b *Backfill) store(articles []*Article) (int, error) {
+	if len(articles) == 0 {
+		return 0, nil
+	}
+
+	var ids []string
+	var byId = make(map[string]*Article)
+
+	for _, a := range articles {
+		ids = append(ids, a.Id)
+		byId[a.Id] = a
+	}
+
+	var unknown, err = b.Store.NewIds(ids)
+
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range unknown {
+		if err := b.Sink.Put(byId[id]); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(unknown), nil
+}
+
+func isLink(n *node) bool {
+	if !n.isTag("a") && !n.isTag("link") {
+		return false
+	}
+
+	var _, ok = n.attribute("href")
+
+	return ok
+}
+
+func backfill(args []string) {
+	var flags = flag.NewFlagSet("backfill", flag.ExitOnError)
+	var since = flags.String("since", "", "skip articles dated before this day, e.g. 2012-01-31")
+	var depth = flags.Int("depth", 0, "number of pages to walk, overrides the configuration")
+	var size = flags.Int("batch", batchSize, "number of articles written per batch")
+
+	flags.Parse(args)
+
+	var cutoff time.Time
+
+	if *since != "" {
+		var t, err = time.Parse("2006-01-02", *since)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cutoff = t
+	}
+
+	for _, name := range flags.Args() {
+		var c = config.Source(name).Backfill
+
+		if c == nil {
+			log.Fatal("No backfill configured for ", name)
+		}
+
+		var store, err = OpenStore(name)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var sink = NewDatabaseSink(store, *size, time.Minute)
+		b, err := NewBackfill(store, c, sink)
+
+		if err != nil {
+			log.Fatal(name, ": ", err)
+		}
+
+		b.Since = cutoff
+		b.Scope, err = SourceScope(name)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if *depth > 0 {
+			b.Depth = *depth
+		}
+
+		n, err := b.Run()
+
+		if err := sink.Close(); err != nil {
+			log.Fatal(err)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("Backfilled", n, "articles of", name)
+	}
+}
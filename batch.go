@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// BatchFilter selects the articles ReadBatchAfter reads.
+type BatchFilter int
+
+const (
+	AllArticles BatchFilter = iota
+	// OldArticles are the ones that still have SiteData.
+	OldArticles
+)
+
+// BatchIterator reads the articles of a store in batches ordered by their
+// storage key. Long running jobs commit after every processed batch and
+// resume from the checkpoint saved under the iterator's name, so every
+// article is processed once even if the job changes the fields the filter
+// looks at.
+type BatchIterator struct {
+	store  ArticleStore
+	name   string
+	filter BatchFilter
+	size   int
+	// cursor is the key of the last article handed out.
+	cursor string
+	// held is set once a batch had failed articles, the checkpoint stays
+	// before that batch.
+	held bool
+}
+
+func NewBatchIterator(store ArticleStore, name string, filter BatchFilter, size int) (*BatchIterator, error) {
+	var cursor, err = store.Checkpoint(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &BatchIterator{store: store, name: name, filter: filter, size: size, cursor: cursor}, nil
+}
+
+// Next returns the batch after the last one, it is empty at the end.
+func (it *BatchIterator) Next() ([]*Article, error) {
+	var batch, cursor, err = it.store.ReadBatchAfter(it.filter, it.cursor, it.size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(batch) > 0 {
+		it.cursor = cursor
+	}
+
+	return batch, nil
+}
+
+// Commit saves the position after the last batch returned by Next. result
+// is the write of that batch, nil if nothing was written. Once articles
+// failed, the checkpoint is not moved past them for the rest of the run,
+// so the next run tries them again.
+func (it *BatchIterator) Commit(result *BatchResult) error {
+	if result != nil && len(result.Failed) > 0 {
+		it.held = true
+	}
+
+	if it.held {
+		return nil
+	}
+
+	return it.store.SetCheckpoint(it.name, it.cursor)
+}
+
+// Restart forgets the checkpoint and starts again with the first article.
+func (it *BatchIterator) Restart() error {
+	it.cursor = ""
+	it.held = false
+
+	return it.store.SetCheckpoint(it.name, "")
+}
+
+// BatchResult summarizes a batch write. An article failing does not keep
+// the others from being written, its error is recorded in Failed.
+type BatchResult struct {
+	// Matched counts the articles that were stored already, Modified the
+	// ones of those that changed.
+	Matched  int
+	Modified int
+	Inserted int
+	Failed   map[string]error
+}
+
+func newBatchResult() *BatchResult {
+	return &BatchResult{Failed: make(map[string]error)}
+}
+
+func (r *BatchResult) fail(id string, err error) {
+	r.Failed[id] = err
+}
+
+// add adds the counts of other to r.
+func (r *BatchResult) add(other *BatchResult) {
+	r.Matched += other.Matched
+	r.Modified += other.Modified
+	r.Inserted += other.Inserted
+
+	for id, err := range other.Failed {
+		r.Failed[id] = err
+	}
+}
+
+// Err returns a *BatchError if any article failed.
+func (r *BatchResult) Err() error {
+	if len(r.Failed) == 0 {
+		return nil
+	}
+
+	return &BatchError{r.Failed}
+}
+
+// BatchError lists the articles of a batch that could not be written.
+type BatchError struct {
+	Failed map[string]error
+}
+
+func (e *BatchError) Error() string {
+	var ids []string
+
+	for id := range e.Failed {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return fmt.Sprintf("%d articles not written, %x: %v", len(ids), ids[0], e.Failed[ids[0]])
+}
+
+// logFailed logs every failed article of result.
+func logFailed(result *BatchResult) {
+	for id, err := range result.Failed {
+		log.Printf("Error writing %x %v", id, err)
+	}
+}
@@ -0,0 +1,885 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"launchpad.net/mgo"
+	"launchpad.net/mgo/bson"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrNoBlob = errors.New("Blob not found")
+
+// BlobStore keeps compressed pages by the hash of their content, so pages
+// stored by several articles are kept once. It counts the references of
+// every blob, those without any are removed by Collect.
+type BlobStore interface {
+	// Put stores data under hash unless it is there already and adds a
+	// reference to it. It returns whether data was stored.
+	Put(hash string, data []byte) (bool, error)
+	// Get returns the blob of hash, ErrNoBlob if there is none.
+	Get(hash string) ([]byte, error)
+	// Retain adds a reference to the blob of hash, ErrNoBlob if there is
+	// none.
+	Retain(hash string) error
+	// Release removes a reference to the blob of hash.
+	Release(hash string) error
+	// Replace changes the data of the blob of hash, which must hold the
+	// same page, compressed differently. It returns ErrNoBlob if there is
+	// none.
+	Replace(hash string, data []byte) error
+	// SetRefs replaces the reference counts, blobs not in refs have none.
+	// References added or removed while it runs are kept.
+	SetRefs(refs map[string]int) error
+	// Collect removes the blobs without references and returns how many
+	// there were and their size.
+	Collect() (int, int64, error)
+	Close() error
+}
+
+// PageHash returns the hash that stores page in a BlobStore.
+func PageHash(page []byte) string {
+	var h = sha1.New()
+	h.Write(page)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// blobSource names the source whose database holds the blobs and
+// dictionaries of all sources. It does not move with -unified, the pages of
+// every database refer to the same blobs.
+const blobSource = "blobs"
+
+var (
+	blobsMutex sync.Mutex
+	blobs      BlobStore
+)
+
+// OpenBlobs returns the blob store shared by all sources. It is in the
+// database of the source blobs, with -store in its blobs directory.
+func OpenBlobs() (BlobStore, error) {
+	blobsMutex.Lock()
+	defer blobsMutex.Unlock()
+
+	if blobs != nil {
+		return blobs, nil
+	}
+
+	if *storeDir != "" {
+		var s, err = OpenFileBlobStore(filepath.Join(*storeDir, blobSource))
+
+		if err != nil {
+			return nil, err
+		}
+
+		blobs = s
+
+		return blobs, nil
+	}
+
+	if _, err := connect(blobSource); err != nil {
+		return nil, err
+	}
+
+	var s, err = OpenMongoBlobStore(blobSource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	blobs = s
+
+	return blobs, nil
+}
+
+// closeBlobs closes the shared blob store, if it is open.
+func closeBlobs() error {
+	blobsMutex.Lock()
+	defer blobsMutex.Unlock()
+
+	if blobs == nil {
+		return nil
+	}
+
+	var err = blobs.Close()
+	blobs = nil
+
+	return err
+}
+
+// LoadBlob returns the blob of hash from the shared blob store.
+func LoadBlob(hash string) ([]byte, error) {
+	var s, err = OpenBlobs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Get(hash)
+}
+
+// retainBlob adds a reference to the blob of hash in the shared blob store.
+func retainBlob(hash string) error {
+	var s, err = OpenBlobs()
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.Retain(hash); err != nil && err != ErrNoBlob {
+		return err
+	}
+
+	return nil
+}
+
+// releaseBlob removes a reference to the blob of hash from the shared blob
+// store.
+func releaseBlob(hash string) error {
+	var s, err = OpenBlobs()
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.Release(hash); err != nil && err != ErrNoBlob {
+		return err
+	}
+
+	return nil
+}
+
+// putBlob compresses page with dict into the shared blob store and returns
+// its hash. The caller owns the reference it added.
+func putBlob(page []byte, dict *Dictionary) (string, error) {
+	var s, err = OpenBlobs()
+
+	if err != nil {
+		return "", err
+	}
+
+	data, err := Compress(bytes.NewReader(page), dict)
+
+	if err != nil {
+		return "", err
+	}
+
+	var hash = PageHash(page)
+
+	if _, err := s.Put(hash, data); err != nil {
+		return "", err
+	}
+
+	return hash, nil
+}
+
+// addedBlob returns the hash of the blob a gains a reference to when it
+// replaces stored, which is nil for a new article, "" if there is none.
+func addedBlob(stored, a *Article) string {
+	if stored != nil && stored.WebsiteHash == a.WebsiteHash {
+		return ""
+	}
+
+	return a.WebsiteHash
+}
+
+// replacedBlob returns the hash of the blob stored loses a reference to when
+// it is replaced by a, "" if there is none.
+func replacedBlob(stored, a *Article) string {
+	if stored.WebsiteHash == a.WebsiteHash {
+		return ""
+	}
+
+	return stored.WebsiteHash
+}
+
+// retainBlobs adds a reference to every blob of hashes.
+func retainBlobs(hashes []string) error {
+	for _, hash := range hashes {
+		if err := retainBlob(hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseBlobs removes a reference to every blob of hashes.
+func releaseBlobs(hashes []string) error {
+	for _, hash := range hashes {
+		if err := releaseBlob(hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MongoBlobStore keeps blobs in the blobs collection of a database.
+type MongoBlobStore struct {
+	database string
+}
+
+type mongoBlob struct {
+	Hash string "_id"
+	Data []byte
+	Size int
+	Refs int
+}
+
+func OpenMongoBlobStore(database string) (*MongoBlobStore, error) {
+	var session, db, err = copyDb(database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer session.Close()
+
+	if err := db.C("blobs").EnsureIndex(mgo.Index{Key: []string{"refs"}}); err != nil {
+		return nil, err
+	}
+
+	return &MongoBlobStore{database}, nil
+}
+
+func (s *MongoBlobStore) Put(hash string, data []byte) (bool, error) {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer session.Close()
+
+	info, err := db.C("blobs").Upsert(
+		bson.M{"_id": hash},
+		bson.M{"$setOnInsert": bson.M{"data": data, "size": len(data)}, "$inc": bson.M{"refs": 1}})
+
+	if err != nil {
+		return false, err
+	}
+
+	return info.UpsertedId != nil, nil
+}
+
+func (s *MongoBlobStore) Get(hash string) ([]byte, error) {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer session.Close()
+
+	var blob mongoBlob
+
+	if err := db.C("blobs").Find(bson.M{"_id": hash}).Select(bson.M{"data": 1}).One(&blob); err == mgo.ErrNotFound {
+		return nil, ErrNoBlob
+	} else if err != nil {
+		return nil, err
+	}
+
+	return blob.Data, nil
+}
+
+func (s *MongoBlobStore) Retain(hash string) error {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return err
+	}
+
+	defer session.Close()
+
+	err = db.C("blobs").Update(bson.M{"_id": hash}, bson.M{"$inc": bson.M{"refs": 1}})
+
+	if err == mgo.ErrNotFound {
+		return ErrNoBlob
+	}
+
+	return err
+}
+
+func (s *MongoBlobStore) Release(hash string) error {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return err
+	}
+
+	defer session.Close()
+
+	err = db.C("blobs").Update(bson.M{"_id": hash}, bson.M{"$inc": bson.M{"refs": -1}})
+
+	if err == mgo.ErrNotFound {
+		return ErrNoBlob
+	}
+
+	return err
+}
+
+func (s *MongoBlobStore) Replace(hash string, data []byte) error {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return err
+	}
+
+	defer session.Close()
+
+	err = db.C("blobs").Update(bson.M{"_id": hash}, bson.M{"$set": bson.M{"data": data, "size": len(data)}})
+
+	if err == mgo.ErrNotFound {
+		return ErrNoBlob
+	}
+
+	return err
+}
+
+func (s *MongoBlobStore) SetRefs(refs map[string]int) error {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return err
+	}
+
+	defer session.Close()
+
+	var c = db.C("blobs")
+	var iter = c.Find(nil).Select(bson.M{"refs": 1}).Iter()
+	var found = make(map[string]bool)
+
+	for blob := new(mongoBlob); iter.Next(blob); blob = new(mongoBlob) {
+		found[blob.Hash] = true
+
+		if refs[blob.Hash] == blob.Refs {
+			continue
+		}
+
+		// Changing the count by the difference keeps what Put and Release
+		// did since it was read.
+		var change = bson.M{"$inc": bson.M{"refs": refs[blob.Hash] - blob.Refs}}
+
+		if err := c.Update(bson.M{"_id": blob.Hash}, change); err != nil && err != mgo.ErrNotFound {
+			iter.Close()
+			return err
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	for hash := range refs {
+		if !found[hash] {
+			log.Println("Articles reference missing blob", hash)
+		}
+	}
+
+	return nil
+}
+
+func (s *MongoBlobStore) Collect() (int, int64, error) {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	defer session.Close()
+
+	var c = db.C("blobs")
+	var orphans = bson.M{"refs": bson.M{"$lte": 0}}
+	var iter = c.Find(orphans).Select(bson.M{"size": 1}).Iter()
+	var count, size = 0, int64(0)
+	var blob mongoBlob
+
+	for iter.Next(&blob) {
+		// A blob referenced again since it was found is kept.
+		var err = c.Remove(bson.M{"_id": blob.Hash, "refs": bson.M{"$lte": 0}})
+
+		if err == mgo.ErrNotFound {
+			continue
+		}
+
+		if err != nil {
+			iter.Close()
+			return count, size, err
+		}
+
+		count++
+		size += int64(blob.Size)
+	}
+
+	return count, size, iter.Close()
+}
+
+func (s *MongoBlobStore) Close() error {
+	return nil
+}
+
+// FileBlobStore keeps every blob in a file named by its hash. Changes of the
+// reference counts are appended to refs.log as lines of hash and change.
+type FileBlobStore struct {
+	dir string
+
+	mutex sync.Mutex
+	refs  map[string]int
+	log   *os.File
+}
+
+func OpenFileBlobStore(dir string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var s = &FileBlobStore{dir: dir, refs: make(map[string]int)}
+
+	var clean, err = s.loadRefs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, "refs.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.log = file
+
+	if !clean {
+		// Drop the partly written line before appending to it.
+		if err := s.rewrite(s.refs); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// loadRefs reads refs.log and returns whether it ended with a complete
+// line.
+func (s *FileBlobStore) loadRefs() (bool, error) {
+	var file, err = os.Open(filepath.Join(s.dir, "refs.log"))
+
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	var reader = bufio.NewReader(file)
+
+	for {
+		var line, err = reader.ReadString('\n')
+
+		if err == io.EOF {
+			return line == "", nil
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		var fields = strings.Fields(line)
+
+		if len(fields) != 2 {
+			return false, fmt.Errorf("Invalid line in %s: %q", file.Name(), line)
+		}
+
+		n, err := strconv.Atoi(fields[1])
+
+		if err != nil {
+			return false, err
+		}
+
+		s.refs[fields[0]] += n
+	}
+}
+
+func (s *FileBlobStore) path(hash string) string {
+	if len(hash) < 2 {
+		return filepath.Join(s.dir, hash)
+	}
+
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+func (s *FileBlobStore) change(hash string, n int) error {
+	if _, err := fmt.Fprintf(s.log, "%s %+d\n", hash, n); err != nil {
+		return err
+	}
+
+	s.refs[hash] += n
+
+	return nil
+}
+
+func (s *FileBlobStore) Put(hash string, data []byte) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var path = s.path(hash)
+	var stored = false
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return false, err
+		}
+
+		if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+			return false, err
+		}
+
+		if err := os.Rename(path+".tmp", path); err != nil {
+			return false, err
+		}
+
+		stored = true
+	} else if err != nil {
+		return false, err
+	}
+
+	return stored, s.change(hash, 1)
+}
+
+func (s *FileBlobStore) Get(hash string) ([]byte, error) {
+	var data, err = ioutil.ReadFile(s.path(hash))
+
+	if os.IsNotExist(err) {
+		return nil, ErrNoBlob
+	}
+
+	return data, err
+}
+
+func (s *FileBlobStore) Retain(hash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := os.Stat(s.path(hash)); os.IsNotExist(err) {
+		return ErrNoBlob
+	}
+
+	return s.change(hash, 1)
+}
+
+func (s *FileBlobStore) Release(hash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, err := os.Stat(s.path(hash)); os.IsNotExist(err) {
+		return ErrNoBlob
+	}
+
+	return s.change(hash, -1)
+}
+
+func (s *FileBlobStore) Replace(hash string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var path = s.path(hash)
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ErrNoBlob
+	}
+
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *FileBlobStore) SetRefs(refs map[string]int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var counted = make(map[string]int)
+
+	for hash, n := range refs {
+		if _, err := os.Stat(s.path(hash)); os.IsNotExist(err) {
+			log.Println("Articles reference missing blob", hash)
+			continue
+		}
+
+		counted[hash] = n
+	}
+
+	return s.rewrite(counted)
+}
+
+// rewrite replaces refs.log with one line for every blob with references.
+func (s *FileBlobStore) rewrite(refs map[string]int) error {
+	var path = filepath.Join(s.dir, "refs.log")
+	var buffer = new(bytes.Buffer)
+
+	for hash, n := range refs {
+		if n > 0 {
+			fmt.Fprintf(buffer, "%s %+d\n", hash, n)
+		}
+	}
+
+	if err := ioutil.WriteFile(path+".tmp", buffer.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if err := s.log.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	var file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	s.log = file
+	s.refs = refs
+
+	return nil
+}
+
+func (s *FileBlobStore) Collect() (int, int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var paths, err = filepath.Glob(filepath.Join(s.dir, "??", "*"))
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var count, size = 0, int64(0)
+
+	for _, path := range paths {
+		var hash = filepath.Base(path)
+
+		if s.refs[hash] > 0 || strings.HasSuffix(hash, ".tmp") {
+			continue
+		}
+
+		info, err := os.Stat(path)
+
+		if err != nil {
+			return count, size, err
+		}
+
+		if err := os.Remove(path); err != nil {
+			return count, size, err
+		}
+
+		count++
+		size += info.Size()
+	}
+
+	return count, size, s.rewrite(s.refs)
+}
+
+func (s *FileBlobStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.log.Close()
+}
+
+// dedup moves the pages stored in the articles of sources to the blob
+// store.
+func dedup(args []string) {
+	var flags = flag.NewFlagSet("dedup", flag.ExitOnError)
+	var restart = flags.Bool("restart", false, "start again with the first article instead of the checkpoint")
+
+	flags.Parse(args)
+
+	for _, name := range flags.Args() {
+		var moved, stored, saved, err = Dedup(name, *restart)
+
+		if err != nil {
+			log.Fatal(name, ": ", err)
+		}
+
+		log.Printf("%s: moved %d pages to %d new blobs, %d bytes saved", name, moved, stored, saved)
+	}
+}
+
+// Dedup moves the pages of the articles of a source to the blob store,
+// leaving their hash in WebsiteHash. It returns the number of pages moved,
+// how many of them were new blobs and the bytes saved by the others.
+func Dedup(name string, restart bool) (moved, stored int, saved int64, err error) {
+	store, err := OpenStore(name)
+
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	blobs, err := OpenBlobs()
+
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	batches, err := NewBatchIterator(store, "dedup", AllArticles, batchSize)
+
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if restart {
+		if err := batches.Restart(); err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	for {
+		var batch, err = batches.Next()
+
+		if err != nil {
+			return moved, stored, saved, err
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var changed []*Article
+
+		for _, a := range batch {
+			if a.WebsiteRaw == nil {
+				continue
+			}
+
+			var page, err = articlePage(a)
+
+			if err != nil {
+				log.Printf("Error reading page of %x %v", a.Id, err)
+				continue
+			}
+
+			var hash = PageHash(page)
+			isNew, err := blobs.Put(hash, a.WebsiteRaw)
+
+			if err != nil {
+				return moved, stored, saved, err
+			}
+
+			if isNew {
+				stored++
+			} else {
+				saved += int64(len(a.WebsiteRaw))
+			}
+
+			a.WebsiteHash = hash
+			a.WebsiteRaw = nil
+			changed = append(changed, a)
+		}
+
+		var result *BatchResult
+
+		if len(changed) > 0 {
+			if result, err = store.UpdateWebsiteBatch(changed); err != nil {
+				return moved, stored, saved, err
+			}
+
+			logFailed(result)
+
+			for _, a := range changed {
+				// A failed article keeps its old page, the store released
+				// the blobs the others replaced.
+				if _, failed := result.Failed[a.Id]; !failed {
+					moved++
+					continue
+				}
+
+				if err := blobs.Release(a.WebsiteHash); err != nil && err != ErrNoBlob {
+					return moved, stored, saved, err
+				}
+			}
+		}
+
+		if err := batches.Commit(result); err != nil {
+			return moved, stored, saved, err
+		}
+	}
+
+	return moved, stored, saved, batches.Restart()
+}
+
+// gc removes the blobs no article references.
+func gc(args []string) {
+	var flags = flag.NewFlagSet("gc", flag.ExitOnError)
+	var recount = flags.Bool("recount", false, "count the references of every source again first")
+
+	flags.Parse(args)
+
+	var blobs, err = OpenBlobs()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *recount {
+		var refs, err = CountBlobRefs()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := blobs.SetRefs(refs); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("Articles reference", len(refs), "blobs")
+	}
+
+	count, size, err := blobs.Collect()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("Removed %d blobs of %d bytes", count, size)
+}
+
+// CountBlobRefs counts the articles of all sources referencing every blob.
+func CountBlobRefs() (map[string]int, error) {
+	var iter, err = FindArticles(NewQuery().Website(WebsiteStored).Quarantined())
+
+	if err != nil {
+		return nil, err
+	}
+
+	var refs = make(map[string]int)
+
+	for a := new(Article); iter.Next(a); a = new(Article) {
+		if a.WebsiteHash != "" {
+			refs[a.WebsiteHash]++
+		}
+	}
+
+	return refs, iter.Close()
+}
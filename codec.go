@@ -0,0 +1,624 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Pages are stored flate compressed. Pages compressed with a preset
+// dictionary start with a header byte whose bits 1 and 2 are set, which
+// is the invalid block type 3 for flate, so they can be told apart from
+// pages stored without a header. The other bits of the header hold the
+// codec, the id of the dictionary follows as uvarint.
+const (
+	headerMark     = 0x06
+	headerMask     = 0x06
+	codecFlate     = 0
+	codecFlateDict = 1
+	// codecFlateText marks the text compact extracted from a page. It is
+	// compressed without a dictionary and has no id.
+	codecFlateText = 2
+)
+
+// The size of a flate window, dictionaries are not longer than that.
+const maxDictionarySize = 32 * 1024
+
+var dictDir = flag.String("dicts", "", "directory of the compression dictionaries, by default they are kept with the articles")
+
+// ErrUnknownCodec is returned for pages written by a newer version.
+var ErrUnknownCodec = errors.New("Unknown page codec")
+
+// Dictionary is a flate preset dictionary trained on the pages of a
+// source. The ids are unique across sources. Dictionaries are kept with
+// the articles: in the dictionaries directory of -store, or else in the
+// dictionaries collection of the database the blobs are in. With -dicts,
+// they are files named id-source.dict in that directory.
+type Dictionary struct {
+	Id     int    "_id"
+	Source string "source"
+	Data   []byte "data"
+}
+
+var (
+	dictMutex    sync.Mutex
+	dictionaries map[int]*Dictionary
+)
+
+// dictionaryDir returns the directory of the dictionary files, "" if they
+// are in the database.
+func dictionaryDir() string {
+	if *dictDir != "" {
+		return *dictDir
+	}
+
+	if *storeDir != "" {
+		return filepath.Join(*storeDir, "dictionaries")
+	}
+
+	return ""
+}
+
+// cachedDictionaries reads the stored dictionaries once. The caller holds
+// dictMutex.
+func cachedDictionaries() (map[int]*Dictionary, error) {
+	if dictionaries != nil {
+		return dictionaries, nil
+	}
+
+	var loaded = make(map[int]*Dictionary)
+	var dir = dictionaryDir()
+
+	if dir == "" {
+		var session, db, err = copyDb(blobSource)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer session.Close()
+
+		var stored []*Dictionary
+
+		if err := db.C("dictionaries").Find(nil).All(&stored); err != nil {
+			return nil, err
+		}
+
+		for _, d := range stored {
+			loaded[d.Id] = d
+		}
+
+		dictionaries = loaded
+
+		return dictionaries, nil
+	}
+
+	var paths, err = filepath.Glob(filepath.Join(dir, "*.dict"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, path := range paths {
+		var name = filepath.Base(path)
+		name = name[:len(name)-len(".dict")]
+		var parts = strings.SplitN(name, "-", 2)
+		var id, err = strconv.Atoi(parts[0])
+
+		if err != nil || len(parts) != 2 {
+			log.Println("Ignoring dictionary", path)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		loaded[id] = &Dictionary{id, parts[1], data}
+	}
+
+	dictionaries = loaded
+
+	return dictionaries, nil
+}
+
+// LoadDictionary returns the dictionary with id.
+func LoadDictionary(id int) (*Dictionary, error) {
+	dictMutex.Lock()
+	defer dictMutex.Unlock()
+
+	var dicts, err = cachedDictionaries()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if d, ok := dicts[id]; ok {
+		return d, nil
+	}
+
+	return nil, fmt.Errorf("No dictionary %d", id)
+}
+
+// LatestDictionary returns the newest dictionary of source, nil if there is
+// none.
+func LatestDictionary(source string) (*Dictionary, error) {
+	dictMutex.Lock()
+	defer dictMutex.Unlock()
+
+	var dicts, err = cachedDictionaries()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *Dictionary
+
+	for _, d := range dicts {
+		if d.Source == source && (latest == nil || d.Id > latest.Id) {
+			latest = d
+		}
+	}
+
+	return latest, nil
+}
+
+// SaveDictionary stores data as the newest dictionary of source.
+func SaveDictionary(source string, data []byte) (*Dictionary, error) {
+	dictMutex.Lock()
+	defer dictMutex.Unlock()
+
+	var dicts, err = cachedDictionaries()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var d = &Dictionary{1, source, data}
+
+	for id := range dicts {
+		if id >= d.Id {
+			d.Id = id + 1
+		}
+	}
+
+	if dir := dictionaryDir(); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+
+		var path = filepath.Join(dir, fmt.Sprintf("%d-%s.dict", d.Id, source))
+
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return nil, err
+		}
+	} else {
+		var session, db, err = copyDb(blobSource)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer session.Close()
+
+		if err := db.C("dictionaries").Insert(d); err != nil {
+			return nil, err
+		}
+	}
+
+	dicts[d.Id] = d
+
+	return d, nil
+}
+
+// Compress compresses a page with dict, or without a header if dict is nil.
+func Compress(page io.Reader, dict *Dictionary) ([]byte, error) {
+	if dict == nil {
+		return compress(page, nil, nil)
+	}
+
+	var header = make([]byte, 1+binary.MaxVarintLen64)
+	header[0] = codecFlateDict<<3 | headerMark
+
+	return compress(page, header[:1+binary.PutUvarint(header[1:], uint64(dict.Id))], dict.Data)
+}
+
+// CompressText compresses the text compact extracted from a page, marked
+// so it is not taken for a page.
+func CompressText(text io.Reader) ([]byte, error) {
+	return compress(text, []byte{codecFlateText<<3 | headerMark}, nil)
+}
+
+func compress(page io.Reader, header []byte, dict []byte) ([]byte, error) {
+	var buffer = new(bytes.Buffer)
+	var writer *flate.Writer
+	var err error
+
+	buffer.Write(header)
+
+	if dict == nil {
+		writer, err = flate.NewWriter(buffer, flate.BestCompression)
+	} else {
+		writer, err = flate.NewWriterDict(buffer, flate.BestCompression, dict)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(writer, page); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// PageCodec returns the codec and the dictionary id of a compressed page.
+func PageCodec(data []byte) (codec, dictId int, err error) {
+	if len(data) == 0 || data[0]&headerMask != headerMark {
+		return codecFlate, 0, nil
+	}
+
+	switch codec = int(data[0] >> 3); codec {
+	case codecFlateText:
+		return codec, 0, nil
+	case codecFlateDict:
+		if id, n := binary.Uvarint(data[1:]); n > 0 {
+			return codec, int(id), nil
+		}
+	}
+
+	return codec, 0, ErrUnknownCodec
+}
+
+// Decompress returns a reader of the page compressed in data.
+func Decompress(data []byte) (io.ReadCloser, error) {
+	var codec, dictId, err = PageCodec(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch codec {
+	case codecFlate:
+		return flate.NewReader(bytes.NewReader(data)), nil
+	case codecFlateText:
+		return flate.NewReader(bytes.NewReader(data[1:])), nil
+	}
+
+	dict, err := LoadDictionary(dictId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var _, n = binary.Uvarint(data[1:])
+
+	return flate.NewReaderDict(bytes.NewReader(data[1+n:]), dict.Data), nil
+}
+
+// TrainDictionary builds a dictionary from sample pages. It keeps the
+// lines found in most pages, weighted by their length, with the most
+// valuable ones at the end where flate reaches them with the shortest
+// distances.
+func TrainDictionary(samples [][]byte, size int) []byte {
+	if size > maxDictionarySize {
+		size = maxDictionarySize
+	}
+
+	var pages = make(map[string]int)
+
+	for _, sample := range samples {
+		var seen = make(map[string]bool)
+
+		for _, line := range bytes.SplitAfter(sample, []byte("\n")) {
+			if len(line) < 8 || seen[string(line)] {
+				continue
+			}
+
+			seen[string(line)] = true
+			pages[string(line)]++
+		}
+	}
+
+	var lines []scoredLine
+
+	for line, n := range pages {
+		if n > 1 {
+			lines = append(lines, scoredLine{line, n * len(line)})
+		}
+	}
+
+	sort.Sort(byScore(lines))
+
+	var chosen []string
+	var total = 0
+
+	for i := len(lines) - 1; i >= 0 && total < size; i-- {
+		if total+len(lines[i].line) > size {
+			continue
+		}
+
+		chosen = append(chosen, lines[i].line)
+		total += len(lines[i].line)
+	}
+
+	var dict = new(bytes.Buffer)
+
+	for i := len(chosen) - 1; i >= 0; i-- {
+		dict.WriteString(chosen[i])
+	}
+
+	return dict.Bytes()
+}
+
+type scoredLine struct {
+	line  string
+	score int
+}
+
+type byScore []scoredLine
+
+func (s byScore) Len() int {
+	return len(s)
+}
+
+func (s byScore) Less(i, j int) bool {
+	return s[i].score < s[j].score
+}
+
+func (s byScore) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// trainDictionary trains a dictionary for sources from the pages of their
+// articles.
+func trainDictionary(args []string) {
+	var flags = flag.NewFlagSet("dict", flag.ExitOnError)
+	var samples = flags.Int("samples", 2000, "number of pages to train on")
+	var size = flags.Int("size", maxDictionarySize, "size of the dictionary in bytes")
+
+	flags.Parse(args)
+
+	for _, name := range flags.Args() {
+		var pages, err = samplePages(name, *samples)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(pages) == 0 {
+			log.Fatal(name, ": no pages to train on")
+		}
+
+		var d *Dictionary
+
+		if d, err = SaveDictionary(name, TrainDictionary(pages, *size)); err != nil {
+			log.Fatal(err)
+		}
+
+		var plain, preset = 0, 0
+
+		for _, page := range pages {
+			var a, _ = Compress(bytes.NewReader(page), nil)
+			var b, _ = Compress(bytes.NewReader(page), d)
+			plain += len(a)
+			preset += len(b)
+		}
+
+		log.Printf("%s: dictionary %d of %d bytes from %d pages, samples %d bytes instead of %d",
+			name, d.Id, len(d.Data), len(pages), preset, plain)
+	}
+}
+
+// samplePages returns up to n pages of the articles of a source.
+func samplePages(name string, n int) ([][]byte, error) {
+	var store, err = OpenStore(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var iter = store.Find(NewQuery().Website(WebsiteAny).SortBy("-firstSeen").Limit(n))
+	var pages [][]byte
+
+	for a := new(Article); iter.Next(a); a = new(Article) {
+		var page, err = articlePage(a)
+
+		if err != nil {
+			log.Printf("Error reading page of %x %v", a.Id, err)
+			continue
+		}
+
+		pages = append(pages, page)
+	}
+
+	return pages, iter.Close()
+}
+
+// recompress compresses the pages of sources again with their newest
+// dictionary and reports the space saved.
+func recompress(args []string) {
+	var flags = flag.NewFlagSet("recompress", flag.ExitOnError)
+	var restart = flags.Bool("restart", false, "start again with the first article instead of the checkpoint")
+
+	flags.Parse(args)
+
+	for _, name := range flags.Args() {
+		var before, after, err = Recompress(name, *restart)
+
+		if err != nil {
+			log.Fatal(name, ": ", err)
+		}
+
+		var saved = 0.0
+
+		if before > 0 {
+			saved = 100 * float64(before-after) / float64(before)
+		}
+
+		log.Printf("%s: %d bytes instead of %d, %.1f%% saved", name, after, before, saved)
+	}
+}
+
+// Recompress compresses the pages of a source with its newest dictionary,
+// also those in the blob store, skipping those that use it already. It returns the sizes of the pages it
+// changed before and after.
+func Recompress(name string, restart bool) (before, after int, err error) {
+	store, err := OpenStore(name)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	d, err := LatestDictionary(name)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if d == nil {
+		return 0, 0, errors.New("No dictionary, train one with the dict command")
+	}
+
+	batches, err := NewBatchIterator(store, "recompress", AllArticles, batchSize)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if restart {
+		if err := batches.Restart(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	for {
+		var batch, err = batches.Next()
+
+		if err != nil {
+			return before, after, err
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var changed []*Article
+
+		for _, a := range batch {
+			if a.WebsiteHash != "" {
+				var n, m, err = recompressBlob(a.WebsiteHash, d)
+
+				if err != nil {
+					log.Printf("Error recompressing blob %s of %x %v", a.WebsiteHash, a.Id, err)
+				}
+
+				before += n
+				after += m
+				continue
+			}
+
+			if a.WebsiteRaw == nil {
+				continue
+			}
+
+			if codec, id, _ := PageCodec(a.WebsiteRaw); codec == codecFlateText || id == d.Id {
+				continue
+			}
+
+			var page, err = a.Website()
+
+			if err != nil {
+				log.Printf("Error reading page of %x %v", a.Id, err)
+				continue
+			}
+
+			data, err := Compress(page, d)
+			page.Close()
+
+			if err != nil {
+				log.Printf("Error compressing page of %x %v", a.Id, err)
+				continue
+			}
+
+			before += len(a.WebsiteRaw)
+			after += len(data)
+			a.WebsiteRaw = data
+			changed = append(changed, a)
+		}
+
+		var result *BatchResult
+
+		if len(changed) > 0 {
+			if result, err = store.UpdateWebsiteBatch(changed); err != nil {
+				return before, after, err
+			}
+
+			logFailed(result)
+		}
+
+		if err := batches.Commit(result); err != nil {
+			return before, after, err
+		}
+	}
+
+	return before, after, batches.Restart()
+}
+
+// recompressBlob compresses the blob of hash again with d unless it uses d
+// already. It returns its sizes before and after, zero if it was kept.
+func recompressBlob(hash string, d *Dictionary) (before, after int, err error) {
+	blobs, err := OpenBlobs()
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	data, err := blobs.Get(hash)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if codec, id, _ := PageCodec(data); codec == codecFlateText || id == d.Id {
+		return 0, 0, nil
+	}
+
+	page, err := Decompress(data)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	compressed, err := Compress(page, d)
+	page.Close()
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if err := blobs.Replace(hash, compressed); err != nil {
+		return 0, 0, err
+	}
+
+	return len(data), len(compressed), nil
+}
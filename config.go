@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	configPath    = flag.String("config", "", "JSON file with per source settings")
+	mongoUser     = flag.String("user", "", "mongo user of all sources, defaults to $GOPAPER_MONGO_USER")
+	mongoPassword = flag.String("password", "", "mongo password of all sources, defaults to $GOPAPER_MONGO_PASSWORD")
+	unified       = flag.String("unified", "", "keep all sources in one database, located like a source of this name that is not crawled, defaults to $GOPAPER_UNIFIED")
+	sourceUrls    = make(sourceValues)
+)
+
+func init() {
+	flag.Var(sourceUrls, "url", "mongo url of a source as name=url, may be repeated")
+}
+
+// Config holds the per source settings read from the file given with -config.
+type Config struct {
+	Sources map[string]*SourceConfig `json:"sources"`
+	// Unified names the source whose database holds the articles of all
+	// sources, it must not be a crawled source. If it is empty, every source
+	// has its own database.
+	Unified string `json:"unified"`
+}
+
+type SourceConfig struct {
+	// Url, User and Password locate the mongo database of the source.
+	Url      string `json:"url"`
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// Database defaults to the name of the source.
+	Database string `json:"database"`
+	// Links selects the LinkChooser, see ParseLinkChooser.
+	Links    string          `json:"links"`
+	Backfill *BackfillConfig `json:"backfill"`
+	// Scope overrides the default scope of the source.
+	Scope *ScopeConfig `json:"scope"`
+	// Minify, if set, minifies pages before they are stored.
+	Minify *MinifyConfig `json:"minify"`
+	// Dedup, if set, stores new pages in the shared blob store.
+	Dedup bool `json:"dedup"`
+	// Retention, if set, moves old pages to the cold archive.
+	Retention *RetentionConfig `json:"retention"`
+}
+
+type BackfillConfig struct {
+	// Pages are the archive pages to walk. A {page} in a page is replaced by
+	// the page number, otherwise rel="next" links are followed.
+	Pages []string `json:"pages"`
+	// Pattern matches the links to articles. The named groups year, month
+	// and day, if present, date the article.
+	Pattern string `json:"pattern"`
+	// Depth is the number of pages walked from each of Pages.
+	Depth int `json:"depth"`
+}
+
+var config = new(Config)
+
+func LoadConfig(path string) (*Config, error) {
+	var file, err = os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var c = new(Config)
+
+	if err := json.NewDecoder(file).Decode(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// ReadConfig loads the -config file, if any, and overrides its database
+// settings with the environment and then with the flags. Per source
+// variables like $GOPAPER_TAGI_URL take precedence over the file,
+// $GOPAPER_MONGO_USER and $GOPAPER_MONGO_PASSWORD only fill in missing
+// credentials.
+func ReadConfig() (*Config, error) {
+	var c = new(Config)
+
+	if *configPath != "" {
+		var loaded, err = LoadConfig(*configPath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		c = loaded
+	}
+
+	if c.Sources == nil {
+		c.Sources = make(map[string]*SourceConfig)
+	}
+
+	for name := range sourceFeeds {
+		if _, ok := c.Sources[name]; !ok {
+			c.Sources[name] = new(SourceConfig)
+		}
+	}
+
+	override(&c.Unified, os.Getenv("GOPAPER_UNIFIED"), *unified)
+
+	for name := range sourceUrls {
+		if _, ok := c.Sources[name]; !ok {
+			c.Sources[name] = new(SourceConfig)
+		}
+	}
+
+	if _, ok := c.Sources[c.Unified]; c.Unified != "" && !ok {
+		c.Sources[c.Unified] = new(SourceConfig)
+	}
+
+	for name, s := range c.Sources {
+		var prefix = "GOPAPER_" + strings.ToUpper(name) + "_"
+
+		if s.User == "" && s.Password == "" {
+			s.User = os.Getenv("GOPAPER_MONGO_USER")
+			s.Password = os.Getenv("GOPAPER_MONGO_PASSWORD")
+		}
+
+		override(&s.Url, os.Getenv(prefix+"URL"), sourceUrls[name])
+		override(&s.User, os.Getenv(prefix+"USER"), *mongoUser)
+		override(&s.Password, os.Getenv(prefix+"PASSWORD"), *mongoPassword)
+	}
+
+	return c, nil
+}
+
+// override sets field to the last non-empty value.
+func override(field *string, values ...string) {
+	for _, v := range values {
+		if v != "" {
+			*field = v
+		}
+	}
+}
+
+// Validate checks the settings of every source and lists all problems.
+func (c *Config) Validate() error {
+	var problems []string
+
+	for name, s := range c.Sources {
+		if _, err := ParseLinkChooser(s.Links); err != nil {
+			problems = append(problems, name+": "+err.Error())
+		}
+
+		if s.Scope != nil {
+			if _, err := NewScope(s.Scope); err != nil {
+				problems = append(problems, name+": scope: "+err.Error())
+			}
+		}
+
+		if s.Minify != nil {
+			if _, err := NewMinifier(s.Minify); err != nil {
+				problems = append(problems, name+": minify: "+err.Error())
+			}
+		}
+
+		if s.Retention != nil && s.Retention.HotDays <= 0 {
+			problems = append(problems, name+": retention: hotDays must be positive")
+		}
+
+		if s.Url != "" && !strings.HasPrefix(s.Url, "mongodb://") && strings.Contains(s.Url, "://") {
+			problems = append(problems, name+": url must be a mongodb:// url or host list")
+		}
+
+		if s.Password != "" && s.User == "" {
+			problems = append(problems, name+": password without user")
+		}
+	}
+
+	if _, ok := sourceFeeds[c.Unified]; ok {
+		problems = append(problems, "unified: "+c.Unified+" is a crawled source, name a database of its own")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("Invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// Source returns the settings of a source, never nil.
+func (c *Config) Source(name string) *SourceConfig {
+	if s, ok := c.Sources[name]; ok {
+		return s
+	}
+
+	return new(SourceConfig)
+}
+
+// sourceValues is a flag holding name=value pairs.
+type sourceValues map[string]string
+
+func (v sourceValues) String() string {
+	var pairs []string
+
+	for name, value := range v {
+		pairs = append(pairs, name+"="+value)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (v sourceValues) Set(pair string) error {
+	var parts = strings.SplitN(pair, "=", 2)
+
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("%q is not of the form name=value", pair)
+	}
+
+	v[parts[0]] = parts[1]
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"time"
+)
+
+var sourceFeeds = map[string]func() []string{
+	"tagi":  TagiFeeds,
+	"blick": BlickFeeds,
+	"min20": MinutenFeeds,
+}
+
+func crawl(args []string) {
+	var flags = flag.NewFlagSet("crawl", flag.ExitOnError)
+	var interval = flags.Duration("interval", 0, "poll the feeds at this interval instead of once")
+	var size = flags.Int("batch", batchSize, "number of articles written per batch")
+	var flush = flags.Duration("flush", 30*time.Second, "maximum time an article waits before it is written")
+	var out = flags.String("out", "", "append articles to this JSON lines file instead of the database")
+	var archive = flags.Bool("archive", true, "keep the raw feed documents for replay")
+	var listen = flags.String("websub", "", "address to receive WebSub pushes on, e.g. :8080")
+	var callback = flags.String("callback", "", "public url of the WebSub address")
+	var secret = flags.String("secret", "", "secret the WebSub hubs sign pushed content with")
+	var lease = flags.Duration("lease", 24*time.Hour, "requested WebSub lease")
+
+	flags.Parse(args)
+
+	var names = flags.Args()
+
+	if len(names) == 0 {
+		for name := range sourceFeeds {
+			names = append(names, name)
+		}
+	}
+
+	var fetches []*Fetch
+	var subscriber *Subscriber
+
+	if *listen != "" {
+		if *callback == "" {
+			log.Fatal("-websub requires -callback")
+		}
+
+		subscriber = NewSubscriber(*callback, *secret, *lease)
+
+		go func() {
+			log.Fatal(http.ListenAndServe(*listen, subscriber))
+		}()
+	}
+
+	for _, name := range names {
+		var feeds, ok = sourceFeeds[name]
+
+		if !ok {
+			log.Fatal("Unknown source ", name)
+		}
+
+		var sink ArticleSink
+		var err error
+
+		if *out != "" {
+			sink, err = OpenJsonSink(*out)
+		} else {
+			sink, err = openDatabaseSink(name, *size, *flush)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer sink.Close()
+
+		chooser, err := ParseLinkChooser(config.Source(name).Links)
+
+		if err != nil {
+			log.Fatal(name, ": ", err)
+		}
+
+		scope, err := SourceScope(name)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var fetch = NewFetch(feeds(), chooser, sink)
+		fetch.Scope = scope
+
+		if *archive {
+			if fetch.Archive, err = OpenArchive(name); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		fetch.Subscriber = subscriber
+
+		fetches = append(fetches, fetch)
+	}
+
+	for _, f := range fetches {
+		if *interval == 0 {
+			f.Once()
+		} else {
+			f.Again(*interval)
+		}
+	}
+
+	// Keep polling or receiving pushes
+	if *interval != 0 || subscriber != nil {
+		select {}
+	}
+}
@@ -1,66 +1,247 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"launchpad.net/mgo"
 	"launchpad.net/mgo/bson"
 	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
-var initialSession map[string]*mgo.Session
+const (
+	dialTimeout = 10 * time.Second
+	// A connection is pinged before it is used if it was not checked for
+	// this long.
+	healthInterval = time.Minute
+)
+
+// mongoConnection dials the database of a source when it is first used and
+// reconnects if it stops answering.
+type mongoConnection struct {
+	name     string
+	url      string
+	user     string
+	password string
+	database string
+
+	mutex   sync.Mutex
+	session *mgo.Session
+	checked time.Time
+}
+
+var (
+	connectionsMutex sync.Mutex
+	connections      = make(map[string]*mongoConnection)
+)
+
+// connect returns the connection of a source. It fails if no url is
+// configured for it, but does not dial yet.
+func connect(name string) (*mongoConnection, error) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+
+	if c, ok := connections[name]; ok {
+		return c, nil
+	}
+
+	var source = config.Source(name)
+
+	if source.Url == "" {
+		return nil, fmt.Errorf(
+			"No mongo url for source %s, set it with -url %s=<url>, $GOPAPER_%s_URL or in the -config file",
+			name, name, strings.ToUpper(name))
+	}
+
+	var c = &mongoConnection{
+		name:     name,
+		url:      source.Url,
+		user:     source.User,
+		password: source.Password,
+		database: source.Database,
+	}
+
+	if c.database == "" {
+		c.database = name
+	}
+
+	connections[name] = c
+
+	return c, nil
+}
+
+// copy returns a copy of the session of c, dialing first if needed.
+func (c *mongoConnection) copy() (*mgo.Session, *mgo.Database, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.session != nil && time.Since(c.checked) > healthInterval {
+		if err := c.session.Ping(); err != nil {
+			log.Println("Reconnecting to", c.name, err)
+			c.session.Close()
+			c.session = nil
+		} else {
+			c.checked = time.Now()
+		}
+	}
+
+	if c.session == nil {
+		var session, err = mgo.DialWithTimeout(c.url, dialTimeout)
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", c.name, err)
+		}
 
-func init() {
-	initialSession = make(map[string]*mgo.Session)
+		if c.user != "" {
+			if err := session.DB(c.database).Login(c.user, c.password); err != nil {
+				session.Close()
+				return nil, nil, fmt.Errorf("%s: %v", c.name, err)
+			}
+		}
 
-	// Dial to Tagesanzeiger
-	var session, err = mgo.Dial(TagiUrl)
+		c.session = session
+		c.checked = time.Now()
+	}
+
+	var copy = c.session.Copy()
+
+	return copy, copy.DB(c.database), nil
+}
+
+// Ping checks that the database of c answers.
+func (c *mongoConnection) Ping() error {
+	var session, _, err = c.copy()
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	session.DB("tagi").Login(MongoUser, MongoPassword)
-	initialSession["tagi"] = session
+	defer session.Close()
+
+	return session.Ping()
+}
+
+// ping checks the databases of the given or else all configured sources.
+func ping(args []string) {
+	var flags = flag.NewFlagSet("ping", flag.ExitOnError)
 
-	// Dial to blick
-	session, err = mgo.Dial(BlickUrl)
+	flags.Parse(args)
+
+	var names = flags.Args()
+
+	if len(names) == 0 {
+		for name := range config.Sources {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+	}
+
+	var failed = false
+
+	for _, name := range names {
+		var c, err = connect(name)
+
+		if err == nil {
+			err = c.Ping()
+		}
+
+		if err != nil {
+			fmt.Println(name, "error:", err)
+			failed = true
+		} else {
+			fmt.Println(name, "ok")
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func copyDb(name string) (*mgo.Session, *mgo.Database, error) {
+	var c, err = connect(name)
 
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-	session.DB("blick").Login(MongoUser, MongoPassword)
-	initialSession["blick"] = session
 
-	// Dial to 20 Minuten
-	session, err = mgo.Dial(MinutenUrl)
+	return c.copy()
+}
 
-	session.DB("min20").Login(MongoUser, MongoPassword)
-	initialSession["min20"] = session
+// MongoStore is the ArticleStore of one mongo database. If source is set,
+// the database holds the articles of several sources and the store only
+// sees those of source.
+type MongoStore struct {
+	database string
+	source   string
 }
 
-func copyDb(database string) (*mgo.Session, *mgo.Database) {
-	var initial = initialSession[database]
-	var copy = initial.Copy()
+func NewMongoStore(database string) *MongoStore {
+	return &MongoStore{database: database}
+}
 
-	return copy, copy.DB(database)
+// NewSourceStore returns the store of source in the shared database.
+func NewSourceStore(database, source string) *MongoStore {
+	return &MongoStore{database: database, source: source}
 }
 
-func ReadBatch(database string, skip, take int) ([]*Article, error) {
-	var session, db = copyDb(database)
+// query restricts query to the source of s.
+func (s *MongoStore) query(query bson.M) bson.M {
+	if s.source == "" {
+		return query
+	}
+
+	var restricted = bson.M{"source": s.source}
+
+	for key, value := range query {
+		restricted[key] = value
+	}
+
+	return restricted
+}
+
+// stamp sets the source of articles written to a shared database.
+func (s *MongoStore) stamp(batch []*Article) {
+	if s.source == "" {
+		return
+	}
+
+	for _, a := range batch {
+		a.Source = s.source
+	}
+}
+
+func (s *MongoStore) ReadBatch(skip, take int) ([]*Article, error) {
+	var session, db, err = copyDb(s.database)
 	var a []*Article
 
+	if err != nil {
+		return nil, err
+	}
+
 	defer session.Close()
-	var err = db.C("articles").Find(nil).Skip(skip).Limit(take).All(&a)
+	err = db.C("articles").Find(s.query(nil)).Skip(skip).Limit(take).All(&a)
 
 	return a, err
 }
 
-func ReadOldBatch(database string, skip, take int) ([]*Article, error) {
-	var session, db = copyDb(database)
+func (s *MongoStore) ReadOldBatch(skip, take int) ([]*Article, error) {
+	var session, db, err = copyDb(s.database)
 	var a []*Article
 
+	if err != nil {
+		return nil, err
+	}
+
 	defer session.Close()
-	var err = db.C("articles").
-		Find(bson.M{"site": bson.M{"$exists": true}}).
+	err = db.C("articles").
+		Find(s.query(bson.M{"site": bson.M{"$exists": true}})).
 		Skip(skip).
 		Limit(take).
 		All(&a)
@@ -68,89 +249,676 @@ func ReadOldBatch(database string, skip, take int) ([]*Article, error) {
 	return a, err
 }
 
-func UpdateBatch(database string, batch []*Article) error {
-	var session, db = copyDb(database)
-	var c = db.C("articles")
+func (s *MongoStore) UpdateBatch(batch []*Article) (*BatchResult, error) {
+	s.stamp(batch)
 
-	defer session.Close()
+	// A replacement cannot use $setOnInsert, so the new articles get their
+	// FirstSeen and Schema before they are written.
+	var unseen []string
 
 	for _, a := range batch {
-		if err := c.Update(bson.M{"id": a.Id}, a); err != nil {
-			return err
+		if a.FirstSeen.IsZero() {
+			unseen = append(unseen, a.Id)
 		}
 	}
 
-	return nil
+	if len(unseen) > 0 {
+		var ids, err = s.NewIds(unseen)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var inserted = make(map[string]bool)
+
+		for _, id := range ids {
+			inserted[id] = true
+		}
+
+		for _, a := range batch {
+			if inserted[a.Id] {
+				a.FirstSeen = time.Now()
+				a.Schema = currentSchema()
+			}
+		}
+	}
+
+	return s.writePages(batch, true, func(a *Article) interface{} {
+		return a
+	})
+}
+
+func (s *MongoStore) UpdateWebsiteBatch(batch []*Article) (*BatchResult, error) {
+	return s.writePages(batch, false, func(a *Article) interface{} {
+		var set, unset = bson.M{"websiteraw": a.WebsiteRaw}, bson.M{}
+
+		if a.WebsiteHash == "" {
+			unset["websiteHash"] = 1
+		} else {
+			set["websiteHash"] = a.WebsiteHash
+		}
+
+		if a.SiteData == nil {
+			unset["site"] = 1
+		} else {
+			set["site"] = a.SiteData
+		}
+
+		if len(unset) == 0 {
+			return bson.M{"$set": set}
+		}
+
+		return bson.M{"$set": set, "$unset": unset}
+	})
+}
+
+func (s *MongoStore) UpdateColdBatch(batch []*Article) (*BatchResult, error) {
+	// The articles are stored without a page, so writePages releases the
+	// blob of any they had.
+	for _, a := range batch {
+		a.WebsiteRaw, a.WebsiteHash, a.SiteData = nil, "", nil
+	}
+
+	return s.writePages(batch, false, func(a *Article) interface{} {
+		return bson.M{
+			"$set":   bson.M{"text": a.Text, "cold": a.Cold},
+			"$unset": bson.M{"websiteraw": 1, "websiteHash": 1, "site": 1},
+		}
+	})
+}
+
+func (s *MongoStore) UpsertBatch(batch []*Article) (*BatchResult, error) {
+	s.stamp(batch)
+
+	return s.writeBatch(batch, true, func(a *Article) interface{} {
+		return bson.M{"$set": feedFields(a), "$setOnInsert": bson.M{"firstSeen": firstSeen(a), "schema": currentSchema()}}
+	})
+}
+
+// writePages writes batch like writeBatch and releases the blobs of the
+// pages it replaced. With upsert, which only UpdateBatch writes pages with,
+// it also adds a reference to the blobs the stored articles did not have.
+func (s *MongoStore) writePages(batch []*Article, upsert bool, change func(a *Article) interface{}) (*BatchResult, error) {
+	var stored, err = s.storedPages(batch)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := s.writeBatch(batch, upsert, change)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var retained, released []string
+
+	for _, a := range batch {
+		if _, failed := result.Failed[a.Id]; failed {
+			continue
+		}
+
+		if hash := addedBlob(stored[a.Id], a); hash != "" && upsert {
+			retained = append(retained, hash)
+		}
+
+		if stored[a.Id] == nil {
+			continue
+		}
+
+		if hash := replacedBlob(stored[a.Id], a); hash != "" {
+			released = append(released, hash)
+		}
+	}
+
+	if err := retainBlobs(retained); err != nil {
+		return result, err
+	}
+
+	return result, releaseBlobs(released)
 }
 
-func UpdateWebsiteBatch(database string, batch []*Article) error {
-	var session, db = copyDb(database)
-	var c = db.C("articles")
+// storedPages returns the stored articles of batch that keep their page
+// in a blob, by id, with only their Id and WebsiteHash.
+func (s *MongoStore) storedPages(batch []*Article) (map[string]*Article, error) {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return nil, err
+	}
 
 	defer session.Close()
 
+	var ids []string
+
 	for _, a := range batch {
-		var err error
+		ids = append(ids, a.Id)
+	}
 
-		if a.SiteData == nil {
-			err = c.Update(
-				bson.M{"id": a.Id},
-				bson.M{"websiteraw": a.WebsiteRaw, "$unset": bson.M{"site": 1}})
-		} else {
-			err = c.Update(
-				bson.M{"id": a.Id},
-				bson.M{"websiteraw": a.WebsiteRaw, "site": a.SiteData})
+	var articles []*Article
+
+	err = db.C("articles").
+		Find(s.query(bson.M{"id": bson.M{"$in": ids}, "websiteHash": bson.M{"$exists": true}})).
+		Select(bson.M{"id": 1, "websiteHash": 1}).
+		All(&articles)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var stored = make(map[string]*Article)
+
+	for _, a := range articles {
+		stored[a.Id] = a
+	}
+
+	return stored, nil
+}
+
+// The server accepts at most this many writes in one command.
+const maxWriteBatch = 1000
+
+// writeBatch applies the change of every article with unordered update
+// commands, so one failing article does not keep the others from being
+// written. Without upsert, articles not stored fail with ErrNotFound.
+func (s *MongoStore) writeBatch(batch []*Article, upsert bool, change func(a *Article) interface{}) (*BatchResult, error) {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer session.Close()
+
+	var result = newBatchResult()
+
+	for len(batch) > 0 {
+		var part = batch
+
+		if len(part) > maxWriteBatch {
+			part = part[:maxWriteBatch]
 		}
 
+		batch = batch[len(part):]
+
+		var partResult, err = s.updateArticles(db, part, upsert, change)
+
 		if err != nil {
-			return err
+			return nil, err
 		}
+
+		result.add(partResult)
 	}
 
-	return nil
+	return result, nil
 }
 
-func NewIds(database string, ids []string) ([]string, error) {
-	var session, db = copyDb(database)
+// updates returns the statements of the update command writing batch.
+func (s *MongoStore) updates(batch []*Article, upsert bool, change func(a *Article) interface{}) []bson.M {
+	var updates []bson.M
+
+	for _, a := range batch {
+		updates = append(updates, bson.M{"q": s.query(bson.M{"id": a.Id}), "u": change(a), "upsert": upsert})
+	}
+
+	return updates
+}
+
+func (s *MongoStore) updateArticles(db *mgo.Database, batch []*Article, upsert bool, change func(a *Article) interface{}) (*BatchResult, error) {
+	var updates = s.updates(batch, upsert, change)
+
+	var reply struct {
+		N        int "n"
+		Modified int "nModified"
+		Upserted []struct {
+			Index int "index"
+		} "upserted"
+		Errors []struct {
+			Index   int    "index"
+			Code    int    "code"
+			Message string "errmsg"
+		} "writeErrors"
+	}
+
+	var command = bson.D{
+		{"update", "articles"},
+		{"updates", updates},
+		{"ordered", false},
+	}
+
+	if err := db.Run(command, &reply); err != nil {
+		return nil, err
+	}
+
+	var result = newBatchResult()
+
+	result.Inserted = len(reply.Upserted)
+	result.Matched = reply.N - result.Inserted
+	result.Modified = reply.Modified
+
+	for _, e := range reply.Errors {
+		result.fail(batch[e.Index].Id, &mgo.LastError{Err: e.Message, Code: e.Code})
+	}
+
+	if upsert || result.Matched+len(result.Failed) == len(batch) {
+		return result, nil
+	}
+
+	// The reply only counts the matches, so look up which are missing.
+	var ids []string
+
+	for _, a := range batch {
+		ids = append(ids, a.Id)
+	}
+
+	var stored []struct {
+		Id string "id"
+	}
+
+	err := db.C("articles").
+		Find(s.query(bson.M{"id": bson.M{"$in": ids}})).
+		Select(bson.M{"id": 1}).
+		All(&stored)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var found = make(map[string]bool)
+
+	for _, a := range stored {
+		found[a.Id] = true
+	}
+
+	for _, a := range batch {
+		if _, failed := result.Failed[a.Id]; !failed && !found[a.Id] {
+			result.fail(a.Id, ErrNotFound)
+		}
+	}
+
+	return result, nil
+}
+
+func (s *MongoStore) NewIds(ids []string) ([]string, error) {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return nil, err
+	}
 
 	defer session.Close()
 
-	var exist []struct{ id string }
-	var err = db.C("articles").
-		Find(bson.M{"id": ids}).
+	var stored []struct {
+		Id string "id"
+	}
+
+	err = db.C("articles").
+		Find(s.query(bson.M{"id": bson.M{"$in": ids}})).
 		Select(bson.M{"id": 1}).
-		All(&exist)
+		All(&stored)
 
 	if err != nil {
 		return nil, err
 	}
 
+	var known = make(map[string]bool)
+
+	for _, a := range stored {
+		known[a.Id] = true
+	}
+
 	var res []string
 
-outer:
-	for i := range ids {
-		for _, id := range exist {
-			if id.id == ids[i] {
-				continue outer
-			}
+	for _, id := range ids {
+		if !known[id] {
+			res = append(res, id)
 		}
-
-		res = append(res, ids[i])
 	}
 
 	return res, nil
 }
 
-func Articles(database string) (*mgo.Iter, func()) {
-	var session, db = copyDb(database)
+func (s *MongoStore) Ids() ([]string, error) {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer session.Close()
+
+	var ids []string
+	var a struct {
+		Id string "id"
+	}
+
+	var iter = db.C("articles").Find(s.query(nil)).Select(bson.M{"id": 1}).Iter()
+
+	for iter.Next(&a) {
+		ids = append(ids, a.Id)
+	}
+
+	return ids, iter.Close()
+}
+
+func (s *MongoStore) Find(q *Query) ArticleIter {
+	var session, db, err = copyDb(s.database)
 
-	return db.C("articles").Find(nil).Iter(), func() { session.Close() }
+	if err != nil {
+		return &errorIter{err}
+	}
+
+	var query = db.C("articles").Find(s.query(q.bson()))
+
+	if q.sort != "" {
+		query = query.Sort(q.sort)
+	}
+
+	if q.limit > 0 {
+		query = query.Limit(q.limit)
+	}
+
+	return &mongoIter{query.Iter(), session}
 }
 
-func Update(database string, a *Article) error {
-	var session, db = copyDb(database)
+func (s *MongoStore) Articles() ArticleIter {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return &errorIter{err}
+	}
+
+	return &mongoIter{db.C("articles").Find(s.query(nil)).Iter(), session}
+}
+
+func (s *MongoStore) Update(a *Article) error {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return err
+	}
 
 	defer session.Close()
 
-	return db.C("articles").Update(bson.M{"id": a.Id}, a)
+	s.stamp([]*Article{a})
+
+	stored, err := s.storedPages([]*Article{a})
+
+	if err != nil {
+		return err
+	}
+
+	if err := mongoError(db.C("articles").Update(s.query(bson.M{"id": a.Id}), a)); err != nil {
+		return err
+	}
+
+	if stored[a.Id] != nil {
+		if hash := replacedBlob(stored[a.Id], a); hash != "" {
+			return releaseBlob(hash)
+		}
+	}
+
+	return nil
+}
+
+// ReadBatchAfter uses the _id as key, which unlike skipping does not depend
+// on the documents that were read before.
+func (s *MongoStore) ReadBatchAfter(filter BatchFilter, cursor string, take int) ([]*Article, string, error) {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer session.Close()
+
+	var query = s.query(bson.M{})
+
+	if cursor != "" {
+		if !bson.IsObjectIdHex(cursor) {
+			return nil, "", errors.New("Invalid cursor " + cursor)
+		}
+
+		query["_id"] = bson.M{"$gt": bson.ObjectIdHex(cursor)}
+	}
+
+	if filter == OldArticles {
+		query["site"] = bson.M{"$exists": true}
+	}
+
+	var raws []bson.Raw
+
+	err = db.C("articles").Find(query).Sort("_id").Limit(take).All(&raws)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	var batch []*Article
+
+	for _, raw := range raws {
+		var a = new(Article)
+		var key struct {
+			Id bson.ObjectId "_id"
+		}
+
+		if err := raw.Unmarshal(a); err != nil {
+			return nil, "", err
+		}
+
+		if err := raw.Unmarshal(&key); err != nil {
+			return nil, "", err
+		}
+
+		batch = append(batch, a)
+		cursor = key.Id.Hex()
+	}
+
+	return batch, cursor, nil
+}
+
+func (s *MongoStore) Checkpoint(name string) (string, error) {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer session.Close()
+
+	var checkpoint struct {
+		Cursor string
+	}
+
+	err = db.C("checkpoints").Find(bson.M{"_id": s.checkpoint(name)}).One(&checkpoint)
+
+	if err == mgo.ErrNotFound {
+		return "", nil
+	}
+
+	return checkpoint.Cursor, err
+}
+
+func (s *MongoStore) SetCheckpoint(name, cursor string) error {
+	var session, db, err = copyDb(s.database)
+
+	if err != nil {
+		return err
+	}
+
+	defer session.Close()
+
+	_, err = db.C("checkpoints").Upsert(
+		bson.M{"_id": s.checkpoint(name)},
+		bson.M{"$set": bson.M{"cursor": cursor, "updated": time.Now()}})
+
+	return err
+}
+
+// checkpoint returns the key of the checkpoint name, which is shared by
+// all sources of a database.
+func (s *MongoStore) checkpoint(name string) string {
+	if s.source == "" {
+		return name
+	}
+
+	return s.source + "/" + name
+}
+
+type mongoIter struct {
+	iter    *mgo.Iter
+	session *mgo.Session
+}
+
+func (it *mongoIter) Next(a *Article) bool {
+	return it.iter.Next(a)
+}
+
+func (it *mongoIter) Err() error {
+	return it.iter.Err()
+}
+
+func (it *mongoIter) Close() error {
+	var err = it.iter.Close()
+	it.session.Close()
+
+	return err
+}
+
+func mongoError(err error) error {
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// feedFields returns the fields of a that came from a feed. Empty fields are
+// left out so they do not overwrite what is already stored.
+func feedFields(a *Article) bson.M {
+	var fields = bson.M{"id": a.Id, "link": a.Link}
+
+	if a.Title != "" {
+		fields["title"] = a.Title
+	}
+
+	if a.Summary != "" {
+		fields["summary"] = a.Summary
+	}
+
+	if !a.PubDate.IsZero() {
+		fields["pubDate"] = a.PubDate
+	}
+
+	if a.Kind != "" {
+		fields["kind"] = a.Kind
+	}
+
+	if a.Source != "" {
+		fields["source"] = a.Source
+	}
+
+	if a.Section != "" {
+		fields["section"] = a.Section
+	}
+
+	if len(a.Media) > 0 {
+		fields["media"] = a.Media
+	}
+
+	if len(a.Categories) > 0 {
+		fields["categories"] = a.Categories
+	}
+
+	if len(a.Authors) > 0 {
+		fields["authors"] = a.Authors
+	}
+
+	return fields
+}
+
+// ArchiveFeed stores feed, or only the time it was fetched if the same
+// document of the same url is stored already.
+func ArchiveFeed(database string, feed *ArchivedFeed) error {
+	var session, db, err = copyDb(database)
+
+	if err != nil {
+		return err
+	}
+
+	var c = db.C("feeds")
+
+	defer session.Close()
+
+	var query = bson.M{"hash": feed.Hash, "url": feed.Url}
+
+	if feed.Source != "" {
+		query["source"] = feed.Source
+	}
+
+	err = c.Update(query, bson.M{"$push": bson.M{"fetched": feed.Fetched[0]}})
+
+	if err == mgo.ErrNotFound {
+		return c.Insert(feed)
+	}
+
+	return err
+}
+
+// MergeArchivedFeed adds feed to the feeds of database, merging its fetch
+// times with those of a stored copy. Merging a feed twice does no harm.
+func MergeArchivedFeed(database string, feed *ArchivedFeed) error {
+	var session, db, err = copyDb(database)
+
+	if err != nil {
+		return err
+	}
+
+	defer session.Close()
+
+	_, err = db.C("feeds").Upsert(
+		bson.M{"hash": feed.Hash, "url": feed.Url, "source": feed.Source},
+		bson.M{
+			"$setOnInsert": bson.M{"data": feed.Data},
+			"$addToSet":    bson.M{"fetched": bson.M{"$each": feed.Fetched}},
+		})
+
+	return err
+}
+
+// ArchivedFeeds iterates over the feeds of source, or all if it is "".
+func ArchivedFeeds(database, source string) FeedIter {
+	var session, db, err = copyDb(database)
+
+	if err != nil {
+		return &sliceFeedIter{err: err}
+	}
+
+	var query = bson.M{}
+
+	if source != "" {
+		query["source"] = source
+	}
+
+	return &mongoFeedIter{db.C("feeds").Find(query).Iter(), session}
+}
+
+type mongoFeedIter struct {
+	iter    *mgo.Iter
+	session *mgo.Session
+}
+
+func (it *mongoFeedIter) Next(feed *ArchivedFeed) bool {
+	return it.iter.Next(feed)
+}
+
+func (it *mongoFeedIter) Err() error {
+	return it.iter.Err()
+}
+
+func (it *mongoFeedIter) Close() error {
+	var err = it.iter.Close()
+	it.session.Close()
+
+	return err
 }
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// articlePage returns the decompressed page of a, nil if there is none.
+func articlePage(a *Article) ([]byte, error) {
+	var page, err = a.Website()
+
+	if err == ErrNoWebsite {
+		var site, err = a.Site()
+
+		if err == ErrNoData {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		page = site
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer page.Close()
+
+	return ioutil.ReadAll(page)
+}
+
+// export writes the articles selected by the flags to a JSON lines file,
+// with the text of their pages, and their pages to a WARC file.
+func export(args []string) {
+	var flags = flag.NewFlagSet("export", flag.ExitOnError)
+	var source = flags.String("source", "", "source to export, all if empty")
+	var from = flags.String("from", "", "first publication date, like 2012-03-01")
+	var to = flags.String("to", "", "publication date to stop before")
+	var jsonPath = flags.String("jsonl", "", "write the articles to this JSON lines file, - for stdout")
+	var warcPath = flags.String("warc", "", "write the pages to this WARC file, compressed if it ends in .gz")
+	var withText = flags.Bool("text", true, "add the text of the pages to the JSON lines")
+
+	flags.Parse(args)
+
+	if *jsonPath == "" && *warcPath == "" {
+		log.Fatal("Nothing to export, use -jsonl or -warc")
+	}
+
+	var q, err = ParseQuery(url.Values{"source": {*source}, "from": {*from}, "to": {*to}})
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	iter, err := FindArticles(q)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var encoder *json.Encoder
+	var warc *WarcWriter
+
+	if *jsonPath == "-" {
+		encoder = json.NewEncoder(os.Stdout)
+	} else if *jsonPath != "" {
+		var file, err = os.Create(*jsonPath)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer file.Close()
+		encoder = json.NewEncoder(file)
+	}
+
+	if *warcPath != "" {
+		var file, err = os.Create(*warcPath)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer file.Close()
+		warc = NewWarcWriter(file, strings.HasSuffix(*warcPath, ".gz"))
+
+		if err := warc.WriteInfo(filepath.Base(*warcPath)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var articles, pages = 0, 0
+
+	for a := new(Article); iter.Next(a); a = new(Article) {
+		var page, err = articlePage(a)
+
+		if err != nil {
+			log.Printf("Error reading page of %x %v", a.Id, err)
+		}
+
+		if encoder != nil {
+			var j = toJsonArticle(a)
+
+			if *withText && page != nil {
+				if j.Text, err = PageText(bytes.NewReader(page)); err != nil {
+					log.Printf("Error reading text of %x %v", a.Id, err)
+				}
+			}
+
+			if err := encoder.Encode(j); err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if warc != nil && page != nil {
+			if err := warc.WriteArticle(a, page); err != nil {
+				log.Fatal(err)
+			}
+
+			pages++
+		}
+
+		articles++
+	}
+
+	if err := iter.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	log.Println("Exported", articles, "articles and", pages, "pages")
+}
+
+// importer writes imported articles to the stores of their sources in
+// batches.
+type importer struct {
+	// source overrides the source of the articles.
+	source  string
+	pages   bool
+	batches map[string][]*Article
+	stored  int
+	failed  int
+}
+
+func (im *importer) add(source string, a *Article) error {
+	if im.source != "" {
+		source = im.source
+	}
+
+	if source == "" {
+		return errors.New("No source for " + a.Link + ", use -source")
+	}
+
+	im.batches[source] = append(im.batches[source], a)
+
+	if len(im.batches[source]) >= batchSize {
+		return im.flush(source)
+	}
+
+	return nil
+}
+
+func (im *importer) flush(source string) error {
+	var batch = im.batches[source]
+	delete(im.batches, source)
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var store, err = OpenStore(source)
+
+	if err != nil {
+		return err
+	}
+
+	var result *BatchResult
+
+	if im.pages {
+		result, err = store.UpdateWebsiteBatch(batch)
+	} else {
+		result, err = store.UpsertBatch(batch)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	logFailed(result)
+
+	if im.pages {
+		// StorePage left the references to the blobs of failed pages
+		// with the importer.
+		for _, a := range batch {
+			if _, failed := result.Failed[a.Id]; failed && a.WebsiteHash != "" {
+				if err := releaseBlob(a.WebsiteHash); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	im.failed += len(result.Failed)
+	im.stored += len(batch) - len(result.Failed)
+
+	return nil
+}
+
+func (im *importer) flushAll() error {
+	for source := range im.batches {
+		if err := im.flush(source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// importJson stores the articles of a JSON lines file written by export.
+func (im *importer) importJson(reader io.Reader) error {
+	var decoder = json.NewDecoder(reader)
+
+	for {
+		var j = new(jsonArticle)
+
+		if err := decoder.Decode(j); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		var a, err = fromJsonArticle(j)
+
+		if err != nil {
+			return err
+		}
+
+		if err := im.add(j.Source, a); err != nil {
+			return err
+		}
+	}
+
+	return im.flushAll()
+}
+
+// importWarc stores the pages of the response records of a WARC file with
+// their articles, which have to be imported first. Records written by
+// other tools, without WARC-Paper-Id, are taken to be of the article with
+// the md5 of their link as id.
+func (im *importer) importWarc(reader io.Reader) error {
+	var warc, err = NewWarcReader(reader)
+
+	if err != nil {
+		return err
+	}
+
+	for {
+		var record, err = warc.Next()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if record.Headers.Get("WARC-Type") != "response" {
+			continue
+		}
+
+		page, err := record.Page()
+
+		if err != nil {
+			return err
+		}
+
+		var a = &Article{Link: record.Headers.Get("WARC-Target-URI")}
+
+		if id := record.Headers.Get("WARC-Paper-Id"); id != "" {
+			var decoded, err = hex.DecodeString(id)
+
+			if err != nil {
+				return err
+			}
+
+			a.Id = string(decoded)
+		} else {
+			var h = md5.New()
+			io.WriteString(h, a.Link)
+			a.Id = string(h.Sum(nil))
+		}
+
+		var source = record.Headers.Get("WARC-Paper-Source")
+
+		if im.source != "" {
+			source = im.source
+		}
+
+		if err := StorePage(source, a, bytes.NewReader(page)); err != nil {
+			return err
+		}
+
+		if err := im.add(source, a); err != nil {
+			return err
+		}
+	}
+
+	return im.flushAll()
+}
+
+// importArticles reads files written by export, JSON lines files first so
+// the pages of WARC files find their articles.
+func importArticles(args []string) {
+	var flags = flag.NewFlagSet("import", flag.ExitOnError)
+	var source = flags.String("source", "", "store all articles in this source instead of their own")
+
+	flags.Parse(args)
+
+	var jsonFiles, warcFiles []string
+
+	for _, path := range flags.Args() {
+		if strings.Contains(filepath.Base(path), ".warc") {
+			warcFiles = append(warcFiles, path)
+		} else {
+			jsonFiles = append(jsonFiles, path)
+		}
+	}
+
+	for _, path := range append(jsonFiles, warcFiles...) {
+		var file, err = os.Open(path)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var im = &importer{source: *source, batches: make(map[string][]*Article)}
+
+		if strings.Contains(filepath.Base(path), ".warc") {
+			im.pages = true
+			err = im.importWarc(file)
+		} else {
+			err = im.importJson(file)
+		}
+
+		file.Close()
+
+		if err != nil {
+			log.Fatal(path, ": ", err)
+		}
+
+		log.Println(path, "stored", im.stored, "failed", im.failed)
+	}
+
+	logMinifyStats()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testStoreDir keeps the stores opened until the returned function is
+// called in a temporary -store directory.
+func testStoreDir(t *testing.T) func() {
+	var dir, err = ioutil.TempDir("", "store")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var saved = *storeDir
+	*storeDir = dir
+
+	return func() {
+		if err := CloseStores(); err != nil {
+			t.Error(err)
+		}
+
+		*storeDir = saved
+		os.RemoveAll(dir)
+	}
+}
+
+func TestJsonRoundTrip(t *testing.T) {
+	defer testStoreDir(t)()
+
+	var a = testArticle("a", "A")
+	a.Summary = "Summary"
+	a.Kind = KindArticle
+	a.Source = "exporttest"
+	a.Section = "schweiz"
+	a.Media = []Media{{Url: "http://example.com/a.jpg", Type: "image/jpeg", Size: 100}}
+	a.Categories = []string{"Schweiz"}
+	a.Authors = []string{"Anna Muster"}
+	a.FirstSeen = time.Date(2013, 5, 1, 13, 0, 0, 0, time.UTC)
+
+	var buffer = new(bytes.Buffer)
+
+	if err := json.NewEncoder(buffer).Encode(toJsonArticle(a)); err != nil {
+		t.Fatal(err)
+	}
+
+	var im = &importer{batches: make(map[string][]*Article)}
+
+	if err := im.importJson(buffer); err != nil {
+		t.Fatal(err)
+	}
+
+	var store, err = OpenStore("exporttest")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch, err := store.ReadBatch(0, 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batch) != 1 {
+		t.Fatalf("imported %q, want a", ids(batch))
+	}
+
+	var got = batch[0]
+	got.Schema = a.Schema
+
+	if !got.FirstSeen.Equal(a.FirstSeen) || !got.PubDate.Equal(a.PubDate) {
+		t.Errorf("imported first seen %v and published %v", got.FirstSeen, got.PubDate)
+	}
+
+	got.FirstSeen, got.PubDate = a.FirstSeen, a.PubDate
+
+	if !reflect.DeepEqual(got, a) {
+		t.Errorf("imported %+v, want %+v", got, a)
+	}
+}
+
+func TestWarcRoundTrip(t *testing.T) {
+	defer testStoreDir(t)()
+
+	var page = []byte("<html><body><p>Page</p></body></html>")
+
+	var store, err = OpenStore("exporttest")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compress := range []bool{false, true} {
+		// The id is not the md5 of the link, so only WARC-Paper-Id finds
+		// the article.
+		var a = testArticle(strconv.FormatBool(compress), "A")
+		a.Source = "exporttest"
+		fill(t, store, a)
+
+		var buffer = new(bytes.Buffer)
+		var w = NewWarcWriter(buffer, compress)
+
+		if err := w.WriteInfo("test.warc"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := w.WriteArticle(a, page); err != nil {
+			t.Fatal(err)
+		}
+
+		var im = &importer{pages: true, batches: make(map[string][]*Article)}
+
+		if err := im.importWarc(buffer); err != nil {
+			t.Fatal(err)
+		}
+
+		if im.stored != 1 || im.failed != 0 {
+			t.Errorf("compress %v: stored %d pages, %d failed", compress, im.stored, im.failed)
+		}
+
+		batch, err := store.ReadBatch(0, 10)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var stored []byte
+
+		for _, b := range batch {
+			if b.Id == a.Id {
+				if stored, err = articlePage(b); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+
+		if !bytes.Equal(stored, page) {
+			t.Errorf("compress %v: imported page %q, want %q", compress, stored, page)
+		}
+	}
+}
@@ -2,45 +2,65 @@ package main
 
 import (
 	"crypto/md5"
-	rss "github.com/akuendig/go-rss"
 	"io"
+	"log"
+	"net/url"
+	"strings"
 	"time"
 )
 
-type LinkChooser func(item *rss.Item) string
+type LinkChooser func(item *Item) string
 
 type Fetch struct {
 	Urls        []string
-	Articles    chan *Article
+	Sink        ArticleSink
+	Archive     FeedArchive
+	Subscriber  *Subscriber
 	LinkChooser LinkChooser
+	// Scope classifies the articles, excluded ones are dropped.
+	Scope *Scope
 
 	stopChannel    chan bool
 	stoppedChannel chan bool
 }
 
-func NewFetch(urls []string, linkChooser LinkChooser) *Fetch {
+func NewFetch(urls []string, linkChooser LinkChooser, sink ArticleSink) *Fetch {
 	var fetch = new(Fetch)
 
 	fetch.Urls = urls
 	fetch.LinkChooser = linkChooser
-	fetch.Articles = make(chan *Article)
+	fetch.Sink = sink
 
 	return fetch
 }
 
-func (f *Fetch) Once() {
-	finished := make(chan bool)
+// FetchResult describes the outcome of fetching one feed.
+type FetchResult struct {
+	Url     string
+	Fetched time.Time
+	Items   int
+	// Malformed is set if the feed was not well formed and its items were
+	// recovered by ParseFeedLenient.
+	Malformed bool
+	Err       error
+}
+
+func (f *Fetch) Once() []*FetchResult {
+	finished := make(chan *FetchResult)
 
 	for _, url := range f.Urls {
 		go func(u string) {
-			f.fetch(u)
-			finished <- true
+			finished <- f.fetch(u)
 		}(url)
 	}
 
+	var results []*FetchResult
+
 	for i := 0; i < len(f.Urls); i++ {
-		<-finished
+		results = append(results, <-finished)
 	}
+
+	return results
 }
 
 func (f *Fetch) Again(interval time.Duration) {
@@ -76,33 +96,144 @@ func (f *Fetch) Stop() {
 	f.stoppedChannel = nil
 }
 
-func DefaultLink(item *rss.Item) string {
-	return item.Link
+func (f *Fetch) fetch(url string) *FetchResult {
+	var result = &FetchResult{Url: url, Fetched: time.Now()}
+
+	data, err := DownloadFeed(url)
+
+	if err != nil {
+		log.Println("Error reading", url, err)
+		result.Err = err
+		return result
+	}
+
+	if f.Archive != nil {
+		if err := f.Archive.Put(url, result.Fetched, data); err != nil {
+			log.Println("Error archiving", url, err)
+		}
+	}
+
+	if f.Subscriber != nil {
+		if hub, topic := FeedHub(data, url); hub != "" {
+			if err := f.Subscriber.Subscribe(hub, topic, f); err != nil {
+				log.Println("Error subscribing to", topic, err)
+			}
+		}
+	}
+
+	items, malformed, err := ParseFeedData(data)
+	result.Malformed = malformed
+
+	if err != nil {
+		log.Println("Error parsing", url, err)
+		result.Err = err
+		return result
+	}
+
+	if malformed {
+		log.Println("Recovered", len(items), "items from malformed feed", url)
+	}
+
+	result.Items = f.store(items)
+
+	return result
+}
+
+// store converts items to articles and passes those in scope to the sink.
+// It returns the number of articles stored.
+func (f *Fetch) store(items []*Item) int {
+	var stored = 0
+
+	for _, item := range items {
+		article := NewArticle(item, f.LinkChooser)
+
+		if f.Scope != nil {
+			article.Kind, _ = f.Scope.Classify(article.Link)
+
+			if article.Kind == KindExcluded {
+				continue
+			}
+		}
+
+		if err := f.Sink.Put(article); err != nil {
+			log.Println("Error storing", article.Link, err)
+			continue
+		}
+
+		stored++
+	}
+
+	return stored
+}
+
+// NewArticle converts a feed item to an article. The id is the md5 sum of
+// the link chosen by linkChooser.
+func NewArticle(item *Item, linkChooser LinkChooser) *Article {
+	link := linkChooser(item)
+
+	h := md5.New()
+	io.WriteString(h, link)
+
+	article := new(Article)
+
+	article.Id = string(h.Sum(nil))
+	article.Title = item.Title
+	article.Link = link
+	article.Section = LinkSection(link)
+	article.PubDate = parsePubDate(item.PubDate)
+	article.Summary = item.Description
+	article.Media = item.Media()
+	article.Categories = item.Categories
+	article.Authors = item.Authors()
+
+	return article
 }
 
-func (f *Fetch) fetch(url string) {
-	channel, err := rss.Read(url)
+// LinkSection returns the first segment of the path of link, which is the
+// section of the newspaper for the sources we crawl.
+func LinkSection(link string) string {
+	var u, err = url.Parse(link)
 
 	if err != nil {
-		return
+		return ""
 	}
 
-	for _, item := range channel.Item {
-		link := f.LinkChooser(item)
+	var path = strings.Trim(u.Path, "/")
 
-		h := md5.New()
-		io.WriteString(h, link)
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i]
+	}
+
+	return ""
+}
 
-		article := new(Article)
+// pubDateLayouts are tried in order. Unlike in time.RFC1123 and
+// time.RFC822, the day may have one digit, and seconds and the weekday
+// may be missing.
+var pubDateLayouts = []string{
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"Mon, 2 Jan 2006 15:04 -0700",
+	"Mon, 2 Jan 2006 15:04 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 MST",
+	"2 Jan 06 15:04 -0700",
+	"2 Jan 06 15:04 MST",
+	time.RFC3339,
+}
 
-		article.Id = string(h.Sum(nil))
-		article.Title = item.Title
-		article.Link = link
-		article.PubDate, _ = time.Parse(time.RFC822, item.PubDate)
-		article.Summary = item.Description
+// parsePubDate accepts the RSS and Atom date formats. It returns the zero
+// time if none of them matches.
+func parsePubDate(date string) time.Time {
+	date = strings.TrimSpace(date)
 
-		f.Articles <- article
+	for _, layout := range pubDateLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t
+		}
 	}
+
+	return time.Time{}
 }
 
 func TagiFeeds() []string {
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/md5"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePubDate(t *testing.T) {
+	var want = time.Date(2013, 5, 2, 13, 4, 5, 0, time.UTC)
+	var noSeconds = time.Date(2013, 5, 2, 13, 4, 0, 0, time.UTC)
+
+	var tests = []struct {
+		date string
+		want time.Time
+	}{
+		{"Thu, 02 May 2013 15:04:05 +0200", want},
+		{"Thu, 2 May 2013 15:04:05 +0200", want},
+		{"Thu, 2 May 2013 13:04:05 GMT", want},
+		{"Thu, 02 May 2013 13:04:05 UTC", want},
+		{"Thu, 2 May 2013 15:04 +0200", noSeconds},
+		{"Thu, 2 May 2013 13:04 GMT", noSeconds},
+		{"2 May 2013 15:04:05 +0200", want},
+		{"02 May 13 13:04 GMT", noSeconds},
+		{"2013-05-02T15:04:05+02:00", want},
+		{"  Thu, 2 May 2013 13:04:05 GMT\n", want},
+		{"", time.Time{}},
+		{"yesterday", time.Time{}},
+	}
+
+	for _, test := range tests {
+		if got := parsePubDate(test.date); !got.Equal(test.want) {
+			t.Errorf("parsePubDate(%q) = %v, want %v", test.date, got, test.want)
+		}
+	}
+}
+
+const mediaFeed = `<?xml version="1.0" encoding="utf-8"?>
+<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<channel><title>Test</title>
+<item>
+	<title>Story</title>
+	<link>http://example.com/schweiz/story-1</link>
+	<description>Summary</description>
+	<pubDate>Thu, 2 May 2013 13:04:05 GMT</pubDate>
+	<category>Schweiz</category>
+	<category>Politik</category>
+	<dc:creator>Anna Muster</dc:creator>
+	<author> </author>
+	<enclosure url="http://example.com/a.jpg" type="image/jpeg" length="100"/>
+	<media:content url="http://example.com/a.jpg" type="image/jpeg"/>
+	<media:group>
+		<media:content url="http://example.com/b.mp4" medium="video" fileSize="200">
+			<media:title>Video</media:title>
+		</media:content>
+		<media:content url="http://example.com/b.webm" type="video/webm"/>
+		<media:thumbnail url="http://example.com/b.jpg"/>
+	</media:group>
+</item>
+</channel></rss>`
+
+func TestNewArticle(t *testing.T) {
+	var items, err = ParseFeed(strings.NewReader(mediaFeed))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 1 {
+		t.Fatalf("parsed %d items, want 1", len(items))
+	}
+
+	var a = NewArticle(items[0], DefaultLink)
+	var h = md5.New()
+	io.WriteString(h, "http://example.com/schweiz/story-1")
+
+	if a.Id != string(h.Sum(nil)) || a.Link != "http://example.com/schweiz/story-1" {
+		t.Errorf("article %x %q, want the md5 of its link", a.Id, a.Link)
+	}
+
+	if a.Title != "Story" || a.Summary != "Summary" || a.Section != "schweiz" {
+		t.Errorf("article %q %q in section %q", a.Title, a.Summary, a.Section)
+	}
+
+	if !a.PubDate.Equal(time.Date(2013, 5, 2, 13, 4, 5, 0, time.UTC)) {
+		t.Errorf("article published %v", a.PubDate)
+	}
+
+	if !equalIds(a.Categories, "Schweiz", "Politik") || !equalIds(a.Authors, "Anna Muster") {
+		t.Errorf("article categories %q and authors %q", a.Categories, a.Authors)
+	}
+
+	var want = []Media{
+		{Url: "http://example.com/a.jpg", Type: "image/jpeg", Size: 100},
+		{Url: "http://example.com/b.mp4", Type: "video", Size: 200, Caption: "Video"},
+		{Url: "http://example.com/b.webm", Type: "video/webm"},
+		{Url: "http://example.com/b.jpg", Type: "image"},
+	}
+
+	if len(a.Media) != len(want) {
+		t.Fatalf("article media %+v, want %+v", a.Media, want)
+	}
+
+	for i := range want {
+		if a.Media[i] != want[i] {
+			t.Errorf("media %d is %+v, want %+v", i, a.Media[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,948 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The index is written after this many records were appended. A stale index
+// is caught up by reading the end of the log when the store is opened.
+const indexInterval = 1000
+
+// Records longer than this are taken to be corrupt.
+const maxRecordSize = 1 << 28
+
+// The log is compacted once more than half of it and at least this many
+// bytes are records of articles written again since.
+const compactGarbage = 1 << 26
+
+var errCorruptRecord = errors.New("Corrupt record")
+
+// FileStore is an ArticleStore in a directory on the local disk. Every write
+// appends the whole article to articles.log, articles.idx maps the ids to
+// the latest record of each article.
+type FileStore struct {
+	dir string
+
+	mutex   sync.RWMutex
+	log     *os.File
+	index   fileIndex
+	unsaved int
+}
+
+type fileIndex struct {
+	// Size is the length of the log the index covers.
+	Size    int64
+	Order   []string
+	Entries map[string]fileEntry
+	// Garbage is the length of the records that were replaced.
+	Garbage int64
+}
+
+type fileEntry struct {
+	Offset int64
+	// Old is set if the article still has SiteData.
+	Old bool
+	// Length is the length of the record, 0 in indexes written before it
+	// was recorded.
+	Length int64
+}
+
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var file, err = os.OpenFile(filepath.Join(dir, "articles.log"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var s = &FileStore{dir: dir, log: file}
+
+	if err := s.loadIndex(); err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Rebuilding index of", dir, err)
+		}
+
+		s.index = fileIndex{Entries: make(map[string]fileEntry)}
+	}
+
+	if err := s.catchUp(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) loadIndex() error {
+	var file, err = os.Open(filepath.Join(s.dir, "articles.idx"))
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	if err := gob.NewDecoder(bufio.NewReader(file)).Decode(&s.index); err != nil {
+		return err
+	}
+
+	if s.index.Entries == nil {
+		s.index.Entries = make(map[string]fileEntry)
+	}
+
+	return nil
+}
+
+func (s *FileStore) saveIndex() error {
+	var path = filepath.Join(s.dir, "articles.idx")
+	var file, err = os.Create(path + ".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	var writer = bufio.NewWriter(file)
+
+	if err := gob.NewEncoder(writer).Encode(&s.index); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	s.unsaved = 0
+
+	return os.Rename(path+".tmp", path)
+}
+
+// catchUp adds the records written after the index to it. A partly written
+// record at the end of the log is cut off.
+func (s *FileStore) catchUp() error {
+	var info, err = s.log.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	if s.index.Size > info.Size() {
+		s.index = fileIndex{Entries: make(map[string]fileEntry)}
+	}
+
+	var reader = bufio.NewReader(io.NewSectionReader(s.log, s.index.Size, info.Size()-s.index.Size))
+	var offset = s.index.Size
+
+	for offset < info.Size() {
+		var a Article
+		var n, err = readRecord(reader, &a)
+
+		if err == io.ErrUnexpectedEOF || err == errCorruptRecord {
+			log.Println("Truncating", s.log.Name(), "at", offset, err)
+
+			if err := s.log.Truncate(offset); err != nil {
+				return err
+			}
+
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		s.indexRecord(&a, offset, n)
+		s.unsaved++
+		offset += n
+	}
+
+	s.index.Size = offset
+
+	return nil
+}
+
+func (s *FileStore) indexRecord(a *Article, offset, length int64) {
+	if entry, ok := s.index.Entries[a.Id]; ok {
+		s.index.Garbage += entry.Length
+	} else {
+		s.index.Order = append(s.index.Order, a.Id)
+	}
+
+	s.index.Entries[a.Id] = fileEntry{offset, a.SiteData != nil, length}
+}
+
+// append writes articles to the end of the log. A record that could not be
+// written completely is cut off again, and the log is compacted once it
+// holds enough garbage. The caller holds the lock.
+func (s *FileStore) append(articles ...*Article) error {
+	for _, a := range articles {
+		var n, err = writeRecord(s.log, a)
+
+		if err != nil {
+			// The next records would be indexed at the wrong offset.
+			if err := s.log.Truncate(s.index.Size); err != nil {
+				return err
+			}
+
+			return err
+		}
+
+		s.indexRecord(a, s.index.Size, n)
+		s.index.Size += n
+		s.unsaved++
+	}
+
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+
+	if s.index.Garbage >= compactGarbage && s.index.Garbage*2 > s.index.Size {
+		return s.compact()
+	}
+
+	if s.unsaved >= indexInterval {
+		return s.saveIndex()
+	}
+
+	return nil
+}
+
+// Compact rewrites the log without the records of articles that were
+// written again since.
+func (s *FileStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.compact()
+}
+
+// compact writes the latest record of every article to a new log and
+// replaces the old one with it. The index is removed first, so a crash
+// before the new one is saved rebuilds it from whichever log is in place.
+// The caller holds the lock.
+func (s *FileStore) compact() error {
+	var path = s.log.Name()
+	var file, err = os.Create(path + ".tmp")
+
+	if err != nil {
+		return err
+	}
+
+	var writer = bufio.NewWriter(file)
+	var index = fileIndex{Entries: make(map[string]fileEntry)}
+
+	for _, id := range s.index.Order {
+		var a, err = s.read(id)
+
+		if err == nil {
+			var n int64
+
+			if n, err = writeRecord(writer, a); err == nil {
+				index.Order = append(index.Order, id)
+				index.Entries[id] = fileEntry{index.Size, a.SiteData != nil, n}
+				index.Size += n
+			}
+		}
+
+		if err != nil {
+			file.Close()
+			os.Remove(path + ".tmp")
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(s.dir, "articles.idx")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	reopened, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Compacted %s from %d to %d bytes", path, s.index.Size, index.Size)
+
+	s.log.Close()
+	s.log = reopened
+	s.index = index
+
+	return s.saveIndex()
+}
+
+// read returns the stored article with id. The caller holds the lock.
+func (s *FileStore) read(id string) (*Article, error) {
+	var entry, ok = s.index.Entries[id]
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	var a = new(Article)
+	var reader = bufio.NewReader(io.NewSectionReader(s.log, entry.Offset, s.index.Size-entry.Offset))
+
+	if _, err := readRecord(reader, a); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (s *FileStore) ReadBatch(skip, take int) ([]*Article, error) {
+	return s.readBatch(skip, take, false)
+}
+
+func (s *FileStore) ReadOldBatch(skip, take int) ([]*Article, error) {
+	return s.readBatch(skip, take, true)
+}
+
+func (s *FileStore) readBatch(skip, take int, old bool) ([]*Article, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var batch []*Article
+
+	for _, id := range s.index.Order {
+		if old && !s.index.Entries[id].Old {
+			continue
+		}
+
+		if skip > 0 {
+			skip--
+			continue
+		}
+
+		if len(batch) == take {
+			break
+		}
+
+		var a, err = s.read(id)
+
+		if err != nil {
+			return nil, err
+		}
+
+		batch = append(batch, a)
+	}
+
+	return batch, nil
+}
+
+func (s *FileStore) UpdateBatch(batch []*Article) (*BatchResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result = newBatchResult()
+	var updated []*Article
+	var retained, released []string
+
+	for _, a := range batch {
+		var stored, err = s.read(a.Id)
+
+		switch {
+		case err == ErrNotFound:
+			result.Inserted++
+
+			if a.WebsiteHash != "" {
+				retained = append(retained, a.WebsiteHash)
+			}
+
+			if a.FirstSeen.IsZero() {
+				a = copyArticle(a)
+				a.FirstSeen = time.Now()
+				a.Schema = currentSchema()
+			}
+		case err != nil:
+			result.fail(a.Id, err)
+			continue
+		case reflect.DeepEqual(stored, a):
+			result.Matched++
+			continue
+		default:
+			result.Matched++
+			result.Modified++
+
+			if hash := addedBlob(stored, a); hash != "" {
+				retained = append(retained, hash)
+			}
+
+			if hash := replacedBlob(stored, a); hash != "" {
+				released = append(released, hash)
+			}
+		}
+
+		updated = append(updated, a)
+	}
+
+	if err := s.append(updated...); err != nil {
+		return result, err
+	}
+
+	if err := retainBlobs(retained); err != nil {
+		return result, err
+	}
+
+	return result, releaseBlobs(released)
+}
+
+func (s *FileStore) UpdateWebsiteBatch(batch []*Article) (*BatchResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result = newBatchResult()
+	var updated []*Article
+	var released []string
+
+	for _, a := range batch {
+		var stored, err = s.read(a.Id)
+
+		if err != nil {
+			result.fail(a.Id, err)
+			continue
+		}
+
+		result.Matched++
+
+		if bytes.Equal(stored.WebsiteRaw, a.WebsiteRaw) && stored.WebsiteHash == a.WebsiteHash && reflect.DeepEqual(stored.SiteData, a.SiteData) {
+			continue
+		}
+
+		if hash := replacedBlob(stored, a); hash != "" {
+			released = append(released, hash)
+		}
+
+		stored.WebsiteRaw = a.WebsiteRaw
+		stored.WebsiteHash = a.WebsiteHash
+		stored.SiteData = a.SiteData
+		updated = append(updated, stored)
+		result.Modified++
+	}
+
+	if err := s.append(updated...); err != nil {
+		return result, err
+	}
+
+	return result, releaseBlobs(released)
+}
+
+func (s *FileStore) UpdateColdBatch(batch []*Article) (*BatchResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result = newBatchResult()
+	var updated []*Article
+	var released []string
+
+	for _, a := range batch {
+		var stored, err = s.read(a.Id)
+
+		if err != nil {
+			result.fail(a.Id, err)
+			continue
+		}
+
+		result.Matched++
+
+		var cold = *stored
+		cold.Text, cold.Cold = a.Text, a.Cold
+		cold.WebsiteRaw, cold.WebsiteHash, cold.SiteData = nil, "", nil
+
+		if reflect.DeepEqual(stored, &cold) {
+			continue
+		}
+
+		if stored.WebsiteHash != "" {
+			released = append(released, stored.WebsiteHash)
+		}
+
+		updated = append(updated, &cold)
+		result.Modified++
+	}
+
+	if err := s.append(updated...); err != nil {
+		return result, err
+	}
+
+	return result, releaseBlobs(released)
+}
+
+func (s *FileStore) UpsertBatch(batch []*Article) (*BatchResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result = newBatchResult()
+	var updated []*Article
+
+	for _, a := range batch {
+		var stored, err = s.read(a.Id)
+
+		if err == ErrNotFound {
+			var inserted = new(Article)
+			mergeFeedFields(inserted, a)
+			inserted.FirstSeen = firstSeen(a)
+			inserted.Schema = currentSchema()
+			updated = append(updated, inserted)
+			result.Inserted++
+			continue
+		}
+
+		if err != nil {
+			result.fail(a.Id, err)
+			continue
+		}
+
+		var merged = copyArticle(stored)
+		mergeFeedFields(merged, a)
+		result.Matched++
+
+		if !reflect.DeepEqual(stored, merged) {
+			updated = append(updated, merged)
+			result.Modified++
+		}
+	}
+
+	return result, s.append(updated...)
+}
+
+func (s *FileStore) NewIds(ids []string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var res []string
+
+	for _, id := range ids {
+		if _, ok := s.index.Entries[id]; !ok {
+			res = append(res, id)
+		}
+	}
+
+	return res, nil
+}
+
+func (s *FileStore) Ids() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var ids = make([]string, len(s.index.Order))
+	copy(ids, s.index.Order)
+
+	return ids, nil
+}
+
+// Find reads every article to match it and keeps the matches without their
+// pages for sorting, the iterator reads them again.
+func (s *FileStore) Find(q *Query) ArticleIter {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var matches []*Article
+
+	for _, id := range s.index.Order {
+		var a, err = s.read(id)
+
+		if err != nil {
+			return &errorIter{err}
+		}
+
+		if q.Match(a) {
+			a.WebsiteRaw, a.SiteData = nil, nil
+			matches = append(matches, a)
+		}
+	}
+
+	q.sortArticles(matches)
+
+	if q.limit > 0 && len(matches) > q.limit {
+		matches = matches[:q.limit]
+	}
+
+	var ids []string
+
+	for _, a := range matches {
+		ids = append(ids, a.Id)
+	}
+
+	return &fileIter{store: s, ids: ids}
+}
+
+func (s *FileStore) Articles() ArticleIter {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var ids = make([]string, len(s.index.Order))
+	copy(ids, s.index.Order)
+
+	return &fileIter{store: s, ids: ids}
+}
+
+func (s *FileStore) Update(a *Article) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var stored, err = s.read(a.Id)
+
+	if err != nil {
+		return err
+	}
+
+	if err := s.append(a); err != nil {
+		return err
+	}
+
+	if hash := replacedBlob(stored, a); hash != "" {
+		return releaseBlob(hash)
+	}
+
+	return nil
+}
+
+// ReadBatchAfter uses the position in the index as key.
+func (s *FileStore) ReadBatchAfter(filter BatchFilter, cursor string, take int) ([]*Article, string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var start, err = positionCursor(cursor)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	var batch []*Article
+
+	for i := start; i < len(s.index.Order) && len(batch) < take; i++ {
+		var id = s.index.Order[i]
+
+		if filter == OldArticles && !s.index.Entries[id].Old {
+			continue
+		}
+
+		var a, err = s.read(id)
+
+		if err != nil {
+			return nil, "", err
+		}
+
+		batch = append(batch, a)
+		cursor = strconv.Itoa(i)
+	}
+
+	return batch, cursor, nil
+}
+
+func (s *FileStore) Checkpoint(name string) (string, error) {
+	var checkpoints, err = s.checkpoints()
+
+	return checkpoints[name], err
+}
+
+func (s *FileStore) SetCheckpoint(name, cursor string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var checkpoints, err = s.checkpoints()
+
+	if err != nil {
+		return err
+	}
+
+	checkpoints[name] = cursor
+
+	var path = filepath.Join(s.dir, "checkpoints.json")
+	data, err := json.Marshal(checkpoints)
+
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *FileStore) checkpoints() (map[string]string, error) {
+	var checkpoints = make(map[string]string)
+	var data, err = ioutil.ReadFile(filepath.Join(s.dir, "checkpoints.json"))
+
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return checkpoints, json.Unmarshal(data, &checkpoints)
+}
+
+// Close writes the index and closes the log.
+func (s *FileStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.unsaved > 0 {
+		if err := s.saveIndex(); err != nil {
+			return err
+		}
+	}
+
+	return s.log.Close()
+}
+
+type fileIter struct {
+	store *FileStore
+	ids   []string
+	err   error
+}
+
+func (it *fileIter) Next(a *Article) bool {
+	if it.err != nil || len(it.ids) == 0 {
+		return false
+	}
+
+	it.store.mutex.RLock()
+	var stored, err = it.store.read(it.ids[0])
+	it.store.mutex.RUnlock()
+
+	if err != nil {
+		it.err = err
+		return false
+	}
+
+	*a = *stored
+	it.ids = it.ids[1:]
+
+	return true
+}
+
+func (it *fileIter) Err() error {
+	return it.err
+}
+
+func (it *fileIter) Close() error {
+	it.ids = nil
+
+	return nil
+}
+
+// FileArchive is a FeedArchive in feeds.log of a directory. A document is
+// written once per url, later downloads of it only append the url, hash and
+// time.
+type FileArchive struct {
+	mutex  sync.Mutex
+	file   *os.File
+	hashes map[string]bool
+}
+
+func OpenFileArchive(dir string) (*FileArchive, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	var file, err = os.OpenFile(filepath.Join(dir, "feeds.log"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var a = &FileArchive{file: file, hashes: make(map[string]bool)}
+	var iter = a.Feeds()
+
+	for feed := new(ArchivedFeed); iter.Next(feed); feed = new(ArchivedFeed) {
+		a.hashes[feed.key()] = true
+	}
+
+	if err := iter.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *FileArchive) Put(url string, fetched time.Time, data []byte) error {
+	var feed, err = NewArchivedFeed(url, fetched, data)
+
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.hashes[feed.key()] {
+		feed.Data = nil
+	}
+
+	if _, err := writeRecord(a.file, feed); err != nil {
+		return err
+	}
+
+	a.hashes[feed.key()] = true
+
+	return a.file.Sync()
+}
+
+// Feeds reads the whole archive and merges the downloads of each document.
+func (a *FileArchive) Feeds() FeedIter {
+	var info, err = a.file.Stat()
+
+	if err != nil {
+		return &sliceFeedIter{err: err}
+	}
+
+	var reader = bufio.NewReader(io.NewSectionReader(a.file, 0, info.Size()))
+	var feeds []*ArchivedFeed
+	var byKey = make(map[string]*ArchivedFeed)
+
+	for {
+		var feed = new(ArchivedFeed)
+		var _, err = readRecord(reader, feed)
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return &sliceFeedIter{err: err}
+		}
+
+		if known, ok := byKey[feed.key()]; ok {
+			known.Fetched = append(known.Fetched, feed.Fetched...)
+			continue
+		}
+
+		byKey[feed.key()] = feed
+		feeds = append(feeds, feed)
+	}
+
+	return &sliceFeedIter{feeds: feeds}
+}
+
+func (a *FileArchive) Close() error {
+	return a.file.Close()
+}
+
+type sliceFeedIter struct {
+	feeds []*ArchivedFeed
+	err   error
+}
+
+func (it *sliceFeedIter) Next(feed *ArchivedFeed) bool {
+	if len(it.feeds) == 0 {
+		return false
+	}
+
+	*feed = *it.feeds[0]
+	it.feeds = it.feeds[1:]
+
+	return true
+}
+
+func (it *sliceFeedIter) Err() error {
+	return it.err
+}
+
+func (it *sliceFeedIter) Close() error {
+	it.feeds = nil
+
+	return nil
+}
+
+// writeRecord writes v gob encoded behind its length and crc32 checksum. It
+// returns the number of bytes written.
+func writeRecord(w io.Writer, v interface{}) (int64, error) {
+	var buffer = new(bytes.Buffer)
+
+	buffer.Write(make([]byte, 8))
+
+	if err := gob.NewEncoder(buffer).Encode(v); err != nil {
+		return 0, err
+	}
+
+	var record = buffer.Bytes()
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(record)-8))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(record[8:]))
+
+	var n, err = w.Write(record)
+
+	return int64(n), err
+}
+
+// readRecord reads a record written by writeRecord into v. It returns
+// io.EOF at the end of r and io.ErrUnexpectedEOF for a partial record.
+func readRecord(r io.Reader, v interface{}) (int64, error) {
+	var header [8]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+
+	var size = binary.BigEndian.Uint32(header[0:4])
+
+	if size > maxRecordSize {
+		return 0, errCorruptRecord
+	}
+
+	var payload = make([]byte, size)
+
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return 0, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return 0, errCorruptRecord
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(v); err != nil {
+		return 0, err
+	}
+
+	return int64(len(header) + len(payload)), nil
+}
@@ -1,34 +1,131 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
-	"net/http"
+	"os"
 	"regexp"
+	"sort"
 )
 
 const (
 	batchSize = 100
 )
 
+var commands = map[string]func(args []string){
+	"crawl":      crawl,
+	"dedup":      dedup,
+	"dict":       trainDictionary,
+	"export":     export,
+	"gc":         gc,
+	"import":     importArticles,
+	"compact":    compact,
+	"replay":     replay,
+	"retain":     retain,
+	"backfill":   backfill,
+	"scope":      scope,
+	"merge":      merge,
+	"migrate":    migrate,
+	"minify":     minify,
+	"ping":       ping,
+	"query":      query,
+	"recompress": recompress,
+	"schema":     schema,
+	"stats":      stats,
+	"vacuum":     vacuum,
+	"verify":     verify,
+	"serve":      serve,
+}
+
 func main() {
-	var iter, close = Articles("blick")
-	var a Article
+	flag.Usage = usage
+	flag.Parse()
+
+	var c, err = ReadConfig()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := c.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	config = c
+
+	var command, ok = commands[flag.Arg(0)]
+
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	command(flag.Args()[1:])
+
+	if err := CloseStores(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	var names []string
+
+	for name := range commands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: go-paper [flags] command [arguments]")
+	fmt.Fprintln(os.Stderr, "commands:")
+
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  ", name)
+	}
 
-	defer close()
+	flag.PrintDefaults()
+}
+
+func compact(args []string) {
+	var flags = flag.NewFlagSet("compact", flag.ExitOnError)
+	var restart = flags.Bool("restart", false, "start again with the first article instead of the checkpoint")
+
+	flags.Parse(args)
 
-	if !iter.Next(&a) {
-		log.Fatal(iter.Err())
+	for _, name := range flags.Args() {
+		switch name {
+		case "blick":
+			CompactBlick(*restart)
+		case "tagi":
+			CompactTagi(*restart)
+		default:
+			log.Fatal("No compaction for source ", name)
+		}
 	}
-	if !iter.Next(&a) {
-		log.Fatal(iter.Err())
+}
+
+// vacuum compacts the article logs of sources in -store.
+func vacuum(args []string) {
+	var flags = flag.NewFlagSet("vacuum", flag.ExitOnError)
+
+	flags.Parse(args)
+
+	if *storeDir == "" {
+		log.Fatal("Only stores in files can be compacted, set -store")
 	}
 
-	go CompactBlick()
+	for _, name := range flags.Args() {
+		var store, err = OpenStore(name)
 
-	http.ListenAndServe(":6060", nil)
+		if err != nil {
+			log.Fatal(name, ": ", err)
+		}
 
-	//web.Get("/(.*)", hello)
-	//web.Run("0.0.0.0:9999")
+		if err := store.(*FileStore).Compact(); err != nil {
+			log.Fatal(name, ": ", err)
+		}
+	}
 }
 
 var oldLinkRex = regexp.MustCompile(`(.+)-(\d+)$`)
@@ -37,20 +134,52 @@ func HasOldBlickLink(l string) bool {
 	return oldLinkRex.MatchString(l)
 }
 
-func CompactBlick() {
-	var i = 0
-	var hasData = true
+// IsOldBlickArticle reports whether link is an article in the old blick
+// layout, which ExtractBlickOld understands.
+func IsOldBlickArticle(scope *Scope, link string) bool {
+	return scope.Is(link, KindArticle) && HasOldBlickLink(link)
+}
+
+// CompactBlick extracts the article of old blick pages into WebsiteRaw. It
+// resumes where it stopped unless restart is set.
+func CompactBlick(restart bool) {
+	var store, err = OpenStore("blick")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	scope, err := SourceScope("blick")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	batches, err := NewBatchIterator(store, "compact", OldArticles, batchSize)
+
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	for ; hasData; i += batchSize {
+	if restart {
+		if err := batches.Restart(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for i := 0; ; i += batchSize {
 		log.Println("Fetching batch", i)
 
-		var batch, err = ReadOldBatch("blick", i, batchSize)
-		hasData = len(batch) > 0
+		var batch, err = batches.Next()
 
 		if err != nil {
 			log.Fatal(err)
 		}
 
+		if len(batch) == 0 {
+			break
+		}
+
 		for _, a := range batch {
 			if a.WebsiteRaw != nil {
 				// Site was already compressed
@@ -58,6 +187,10 @@ func CompactBlick() {
 				continue
 			}
 
+			if !IsOldBlickArticle(scope, a.Link) {
+				continue
+			}
+
 			var site, err = a.Site()
 
 			if err == ErrNoData {
@@ -69,20 +202,15 @@ func CompactBlick() {
 				continue
 			}
 
-			defer site.Close()
-
-			if !HasOldBlickLink(a.Link) {
-				continue
-			}
-
 			text, err := ExtractBlickOld(site)
+			site.Close()
 
 			if err != nil {
 				log.Println("Error at id", a.Id, err)
 				continue
 			}
 
-			if err := a.SetWebsite(text); err != nil {
+			if err := a.SetExtracted(text); err != nil {
 				log.Println("Error at id", a.Id, err)
 				continue
 			}
@@ -90,25 +218,56 @@ func CompactBlick() {
 			a.SiteData = nil
 		}
 
-		UpdateWebsiteBatch("blick", batch)
-		log.Println("Pushed batch", i)
+		result, err := store.UpdateWebsiteBatch(batch)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		logFailed(result)
+
+		if err := batches.Commit(result); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("Pushed batch", i, "modified", result.Modified, "failed", len(result.Failed))
 	}
 }
 
-func CompactTagi() {
-	var i = 0
-	var hasData = true
+// CompactTagi extracts the article of tagi pages into WebsiteRaw. It resumes
+// where it stopped unless restart is set.
+func CompactTagi(restart bool) {
+	var store, err = OpenStore("tagi")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	batches, err := NewBatchIterator(store, "compact", OldArticles, batchSize)
+
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	for ; hasData; i += batchSize {
+	if restart {
+		if err := batches.Restart(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for i := 0; ; i += batchSize {
 		log.Println("Fetching batch", i)
 
-		var batch, err = ReadOldBatch("tagi", i, batchSize)
-		hasData = len(batch) > 0
+		var batch, err = batches.Next()
 
 		if err != nil {
 			log.Fatal(err)
 		}
 
+		if len(batch) == 0 {
+			break
+		}
+
 		for _, a := range batch {
 			if a.WebsiteRaw != nil {
 				a.SiteData = nil
@@ -134,7 +293,7 @@ func CompactTagi() {
 				continue
 			}
 
-			if err := a.SetWebsite(text); err != nil {
+			if err := a.SetExtracted(text); err != nil {
 				log.Println("Error at id", a.Id, err)
 				continue
 			}
@@ -142,7 +301,18 @@ func CompactTagi() {
 			a.SiteData = nil
 		}
 
-		UpdateWebsiteBatch("tagi", batch)
-		log.Println("Pushed batch", i)
+		result, err := store.UpdateWebsiteBatch(batch)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		logFailed(result)
+
+		if err := batches.Commit(result); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println("Pushed batch", i, "modified", result.Modified, "failed", len(result.Failed))
 	}
 }
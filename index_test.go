@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIsOldBlickArticle(t *testing.T) {
+	var scope, err = NewScope(defaultScopes["blick"])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		link string
+		want bool
+	}{
+		{"http://www.blick.ch/news/schweiz/bundesrat-sagt-nein-123456", true},
+		{"https://www.blick.ch/politik/bundesrat-sagt-nein-id15436912.html", false},
+		{"http://www.blick.ch/news/galerie/bundesrat-sagt-nein-123456", false},
+	}
+
+	for _, test := range tests {
+		if got := IsOldBlickArticle(scope, test.link); got != test.want {
+			t.Errorf("IsOldBlickArticle(%q) = %v, want %v", test.link, got, test.want)
+		}
+	}
+}
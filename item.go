@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Item is a single entry of a feed. RSS items are decoded directly, Atom
+// entries are converted to the same shape.
+type Item struct {
+	Title          string           `xml:"title"`
+	Link           string           `xml:"link"`
+	Description    string           `xml:"description"`
+	PubDate        string           `xml:"pubDate"`
+	Guid           Guid             `xml:"guid"`
+	OrigLink       string           `xml:"http://rssnamespace.org/feedburner/ext/1.0 origLink"`
+	Categories     []string         `xml:"category"`
+	Author         []string         `xml:"author"`
+	Creator        []string         `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Enclosure      []Enclosure      `xml:"enclosure"`
+	MediaContent   []MediaContent   `xml:"http://search.yahoo.com/mrss/ content"`
+	MediaThumbnail []MediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	MediaGroup     []MediaGroup     `xml:"http://search.yahoo.com/mrss/ group"`
+}
+
+type Guid struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink string `xml:"isPermaLink,attr"`
+}
+
+type Enclosure struct {
+	Url    string `xml:"url,attr"`
+	Type   string `xml:"type,attr"`
+	Length int64  `xml:"length,attr"`
+}
+
+type MediaContent struct {
+	Url         string `xml:"url,attr"`
+	Type        string `xml:"type,attr"`
+	Medium      string `xml:"medium,attr"`
+	FileSize    int64  `xml:"fileSize,attr"`
+	Title       string `xml:"http://search.yahoo.com/mrss/ title"`
+	Description string `xml:"http://search.yahoo.com/mrss/ description"`
+}
+
+type MediaThumbnail struct {
+	Url string `xml:"url,attr"`
+}
+
+// MediaGroup holds media:content elements that are versions of the same
+// media, and their thumbnails.
+type MediaGroup struct {
+	Content   []MediaContent   `xml:"http://search.yahoo.com/mrss/ content"`
+	Thumbnail []MediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+}
+
+// Media returns the enclosures, media:content and media:thumbnail elements
+// of the item, also those in a media:group, each url only once.
+func (item *Item) Media() []Media {
+	var media []Media
+	var seen = make(map[string]bool)
+
+	var add = func(m Media) {
+		if m.Url == "" || seen[m.Url] {
+			return
+		}
+
+		seen[m.Url] = true
+		media = append(media, m)
+	}
+
+	for _, e := range item.Enclosure {
+		add(Media{Url: e.Url, Type: e.Type, Size: e.Length})
+	}
+
+	var contents, thumbnails = item.MediaContent, item.MediaThumbnail
+
+	for _, g := range item.MediaGroup {
+		contents = append(contents, g.Content...)
+		thumbnails = append(thumbnails, g.Thumbnail...)
+	}
+
+	for _, c := range contents {
+		var m = Media{Url: c.Url, Type: c.Type, Size: c.FileSize, Caption: c.Description}
+
+		if m.Type == "" {
+			m.Type = c.Medium
+		}
+
+		if m.Caption == "" {
+			m.Caption = c.Title
+		}
+
+		add(m)
+	}
+
+	for _, t := range thumbnails {
+		add(Media{Url: t.Url, Type: "image"})
+	}
+
+	return media
+}
+
+// Authors returns the author and dc:creator elements of the item.
+func (item *Item) Authors() []string {
+	var authors []string
+
+	for _, a := range append(item.Author, item.Creator...) {
+		if a = strings.TrimSpace(a); a != "" {
+			authors = append(authors, a)
+		}
+	}
+
+	return authors
+}
+
+type atomEntry struct {
+	Id             string           `xml:"id"`
+	Title          string           `xml:"title"`
+	Links          []atomLink       `xml:"link"`
+	Published      string           `xml:"published"`
+	Updated        string           `xml:"updated"`
+	Summary        string           `xml:"summary"`
+	Content        string           `xml:"content"`
+	Categories     []atomCategory   `xml:"category"`
+	Authors        []atomPerson     `xml:"author"`
+	MediaContent   []MediaContent   `xml:"http://search.yahoo.com/mrss/ content"`
+	MediaThumbnail []MediaThumbnail `xml:"http://search.yahoo.com/mrss/ thumbnail"`
+	MediaGroup     []MediaGroup     `xml:"http://search.yahoo.com/mrss/ group"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr"`
+	Length int64  `xml:"length,attr"`
+}
+
+type atomCategory struct {
+	Term  string `xml:"term,attr"`
+	Label string `xml:"label,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+func (e *atomEntry) item() *Item {
+	var item = &Item{
+		Title:          e.Title,
+		Description:    e.Summary,
+		PubDate:        e.Published,
+		Guid:           Guid{Value: e.Id, IsPermaLink: "false"},
+		MediaContent:   e.MediaContent,
+		MediaThumbnail: e.MediaThumbnail,
+		MediaGroup:     e.MediaGroup,
+	}
+
+	if item.Description == "" {
+		item.Description = e.Content
+	}
+
+	if item.PubDate == "" {
+		item.PubDate = e.Updated
+	}
+
+	for _, l := range e.Links {
+		switch l.Rel {
+		case "", "alternate":
+			if item.Link == "" {
+				item.Link = l.Href
+			}
+		case "enclosure":
+			item.Enclosure = append(item.Enclosure, Enclosure{Url: l.Href, Type: l.Type, Length: l.Length})
+		}
+	}
+
+	for _, c := range e.Categories {
+		if c.Label != "" {
+			item.Categories = append(item.Categories, c.Label)
+		} else {
+			item.Categories = append(item.Categories, c.Term)
+		}
+	}
+
+	for _, a := range e.Authors {
+		item.Author = append(item.Author, a.Name)
+	}
+
+	return item
+}
+
+// feedDocument decodes RSS 2.0, RSS 1.0 and Atom documents alike.
+type feedDocument struct {
+	XMLName xml.Name
+	Channel struct {
+		Item []*Item `xml:"item"`
+	} `xml:"channel"`
+	Item  []*Item      `xml:"item"`
+	Entry []*atomEntry `xml:"http://www.w3.org/2005/Atom entry"`
+}
+
+func (doc *feedDocument) items() []*Item {
+	var items = append(doc.Channel.Item, doc.Item...)
+
+	for _, e := range doc.Entry {
+		items = append(items, e.item())
+	}
+
+	return items
+}
+
+// DownloadFeed returns the raw feed document at url.
+func DownloadFeed(url string) ([]byte, error) {
+	var response, err = http.Get(url)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(url + ": " + response.Status)
+	}
+
+	return ioutil.ReadAll(response.Body)
+}
+
+func ParseFeed(reader io.Reader) ([]*Item, error) {
+	var doc feedDocument
+	var decoder = xml.NewDecoder(reader)
+
+	decoder.CharsetReader = charsetReader
+
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	return doc.items(), nil
+}
+
+// charsetReader converts ISO-8859-1 encoded feeds to UTF-8. Windows-1252 is
+// treated the same way, which is close enough for the feeds we read.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+	default:
+		return nil, errors.New("Unsupported charset " + charset)
+	}
+
+	var latin, err = ioutil.ReadAll(input)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var buffer = new(bytes.Buffer)
+
+	for _, b := range latin {
+		buffer.WriteRune(rune(b))
+	}
+
+	return buffer, nil
+}
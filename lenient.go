@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"exp/html"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var xmlEncodingRex = regexp.MustCompile(`^<\?xml[^>]*encoding=["']([^"']+)["']`)
+
+var utf8Bom = []byte("\xef\xbb\xbf")
+
+// ParseFeedData parses a feed strictly and falls back to ParseFeedLenient if
+// that fails. malformed reports whether the fallback was needed.
+func ParseFeedData(data []byte) (items []*Item, malformed bool, err error) {
+	if items, err = ParseFeed(bytes.NewReader(data)); err == nil {
+		return items, false, nil
+	}
+
+	if items, err = ParseFeedLenient(data); err != nil {
+		return nil, true, err
+	}
+
+	return items, true, nil
+}
+
+// ParseFeedLenient recovers the items of a feed that is not well formed XML.
+// It uses the html tokenizer, which copes with unescaped ampersands, unknown
+// entities and unbalanced tags.
+func ParseFeedLenient(data []byte) ([]*Item, error) {
+	if bytes.HasPrefix(data, utf8Bom) {
+		data = data[len(utf8Bom):]
+	}
+
+	var reader io.Reader = bytes.NewReader(unwrapCdata(data))
+
+	if m := xmlEncodingRex.FindSubmatch(data); m != nil && !strings.EqualFold(string(m[1]), "utf-8") {
+		var r, err = charsetReader(string(m[1]), reader)
+
+		if err != nil {
+			return nil, err
+		}
+
+		reader = r
+	}
+
+	var p = new(lenientParser)
+	var z = html.NewTokenizer(reader)
+
+	for {
+		var tt = z.Next()
+
+		switch tt {
+		case html.ErrorToken:
+			if err := z.Err(); err != io.EOF {
+				return nil, err
+			}
+
+			p.endItem()
+
+			return p.items, nil
+		case html.TextToken:
+			p.text(string(z.Text()))
+		case html.StartTagToken, html.SelfClosingTagToken:
+			var t = z.Token()
+
+			p.start(t, string(z.Raw()))
+
+			if tt == html.SelfClosingTagToken {
+				p.end(t.Data, "")
+			}
+		case html.EndTagToken:
+			var t = z.Token()
+
+			p.end(t.Data, string(z.Raw()))
+		}
+	}
+}
+
+// unwrapCdata replaces CDATA sections by their escaped content, the html
+// tokenizer would end them at the first '>'.
+func unwrapCdata(data []byte) []byte {
+	var start, end = []byte("<![CDATA["), []byte("]]>")
+	var buffer = new(bytes.Buffer)
+
+	for {
+		var i = bytes.Index(data, start)
+
+		if i < 0 {
+			break
+		}
+
+		var j = bytes.Index(data[i+len(start):], end)
+
+		if j < 0 {
+			break
+		}
+
+		buffer.Write(data[:i])
+		buffer.WriteString(html.EscapeString(string(data[i+len(start) : i+len(start)+j])))
+		data = data[i+len(start)+j+len(end):]
+	}
+
+	buffer.Write(data)
+
+	return buffer.Bytes()
+}
+
+type lenientParser struct {
+	items []*Item
+	item  *Item
+
+	// field collects the text of the current element, until the end tag
+	// named fieldTag shows up.
+	field    *string
+	fieldTag string
+	author   bool
+}
+
+func (p *lenientParser) start(t html.Token, raw string) {
+	if t.Data == "item" || t.Data == "entry" {
+		p.endItem()
+		p.item = new(Item)
+		return
+	}
+
+	if p.item == nil {
+		return
+	}
+
+	if p.field != nil {
+		if p.author && t.Data == "name" {
+			// Atom authors keep their name in a child element
+			*p.field = ""
+			p.fieldTag = t.Data
+			return
+		}
+
+		// Markup that was not escaped in a text field
+		*p.field += raw
+		return
+	}
+
+	var attr = make(map[string]string)
+
+	for _, a := range t.Attr {
+		attr[a.Key] = a.Val
+	}
+
+	switch t.Data {
+	case "title":
+		p.collect(t.Data, &p.item.Title)
+	case "link":
+		if href, ok := attr["href"]; ok {
+			switch attr["rel"] {
+			case "", "alternate":
+				if p.item.Link == "" {
+					p.item.Link = href
+				}
+			case "enclosure":
+				var length, _ = strconv.ParseInt(attr["length"], 10, 64)
+				p.item.Enclosure = append(p.item.Enclosure, Enclosure{Url: href, Type: attr["type"], Length: length})
+			}
+		} else {
+			p.collect(t.Data, &p.item.Link)
+		}
+	case "description", "summary":
+		p.collect(t.Data, &p.item.Description)
+	case "content":
+		if p.item.Description == "" {
+			p.collect(t.Data, &p.item.Description)
+		}
+	case "pubdate", "published", "dc:date":
+		p.collect(t.Data, &p.item.PubDate)
+	case "updated":
+		if p.item.PubDate == "" {
+			p.collect(t.Data, &p.item.PubDate)
+		}
+	case "guid":
+		p.item.Guid.IsPermaLink = attr["ispermalink"]
+		p.collect(t.Data, &p.item.Guid.Value)
+	case "id":
+		p.item.Guid.IsPermaLink = "false"
+		p.collect(t.Data, &p.item.Guid.Value)
+	case "feedburner:origlink":
+		p.collect(t.Data, &p.item.OrigLink)
+	case "category":
+		if term, ok := attr["term"]; ok {
+			p.item.Categories = append(p.item.Categories, term)
+		} else {
+			p.item.Categories = append(p.item.Categories, "")
+			p.collect(t.Data, &p.item.Categories[len(p.item.Categories)-1])
+		}
+	case "author":
+		p.author = true
+		p.item.Author = append(p.item.Author, "")
+		p.collect(t.Data, &p.item.Author[len(p.item.Author)-1])
+	case "dc:creator":
+		p.item.Creator = append(p.item.Creator, "")
+		p.collect(t.Data, &p.item.Creator[len(p.item.Creator)-1])
+	case "enclosure":
+		var length, _ = strconv.ParseInt(attr["length"], 10, 64)
+		p.item.Enclosure = append(p.item.Enclosure, Enclosure{Url: attr["url"], Type: attr["type"], Length: length})
+	case "media:content":
+		var size, _ = strconv.ParseInt(attr["filesize"], 10, 64)
+		p.item.MediaContent = append(p.item.MediaContent, MediaContent{
+			Url:      attr["url"],
+			Type:     attr["type"],
+			Medium:   attr["medium"],
+			FileSize: size,
+		})
+	case "media:description":
+		if n := len(p.item.MediaContent); n > 0 {
+			p.collect(t.Data, &p.item.MediaContent[n-1].Description)
+		}
+	case "media:thumbnail":
+		p.item.MediaThumbnail = append(p.item.MediaThumbnail, MediaThumbnail{Url: attr["url"]})
+	}
+}
+
+func (p *lenientParser) collect(tag string, field *string) {
+	p.field = field
+	p.fieldTag = tag
+}
+
+func (p *lenientParser) text(text string) {
+	if p.field != nil {
+		*p.field += text
+	}
+}
+
+func (p *lenientParser) end(tag, raw string) {
+	if tag == "item" || tag == "entry" {
+		p.endItem()
+		return
+	}
+
+	if tag == "author" {
+		p.author = false
+	}
+
+	if p.field == nil {
+		return
+	}
+
+	if tag != p.fieldTag {
+		*p.field += raw
+		return
+	}
+
+	*p.field = strings.TrimSpace(*p.field)
+	p.field = nil
+	p.fieldTag = ""
+}
+
+func (p *lenientParser) endItem() {
+	if p.item != nil {
+		p.items = append(p.items, p.item)
+	}
+
+	p.item = nil
+	p.field = nil
+	p.fieldTag = ""
+	p.author = false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseFeedLenient(t *testing.T) {
+	var tests = []struct {
+		name  string
+		feed  string
+		items [][2]string
+	}{
+		{
+			"truncated",
+			`<rss><channel><item><title>First</title><link>http://example.com/a</link></item>
+<item><title>Second</title><link>http://example.com/b`,
+			[][2]string{{"First", "http://example.com/a"}, {"Second", "http://example.com/b"}},
+		},
+		{
+			"bad entities",
+			`<rss><channel><item><title>Tom & Jerry&nbsp;&uuml;ber &bogus;</title>
+<link>http://example.com/a?x=1&y=2</link></item></channel></rss>`,
+			[][2]string{{"Tom & Jerry über &bogus;", "http://example.com/a?x=1&y=2"}},
+		},
+		{
+			"mis-nested",
+			`<rss><channel><item><title>A <b>bold</title></b> <link>http://example.com/a</link>
+<item><title>B</title></link><link>http://example.com/b</link></channel></item></rss>`,
+			[][2]string{{"A <b>bold", "http://example.com/a"}, {"B", "http://example.com/b"}},
+		},
+		{
+			"cdata",
+			`<rss><channel><item><title><![CDATA[1 < 2 & <i>x</i>]]></title><link>http://example.com/a</link></item>`,
+			[][2]string{{"1 < 2 & <i>x</i>", "http://example.com/a"}},
+		},
+		{
+			"bom and latin1",
+			"\xef\xbb\xbf<?xml version=\"1.0\" encoding=\"iso-8859-1\"?>\n" +
+				"<rss><channel><item><title>Z\xfcrich & Bern</title><link>http://example.com/a</link></item></channel></rss>",
+			[][2]string{{"Zürich & Bern", "http://example.com/a"}},
+		},
+	}
+
+	for _, test := range tests {
+		var items, malformed, err = ParseFeedData([]byte(test.feed))
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if !malformed {
+			t.Errorf("%s: parsed as well formed", test.name)
+		}
+
+		if len(items) != len(test.items) {
+			t.Errorf("%s: parsed %d items, want %d", test.name, len(items), len(test.items))
+			continue
+		}
+
+		for i, want := range test.items {
+			if items[i].Title != want[0] || items[i].Link != want[1] {
+				t.Errorf("%s: item %d is %q %q, want %q %q", test.name, i, items[i].Title, items[i].Link, want[0], want[1])
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// linkWrappers maps hosts that wrap the real link in a redirect to the query
+// parameter holding the target.
+var linkWrappers = map[string]string{
+	"news.google.com": "url",
+	"www.google.com":  "url",
+	"www.google.ch":   "url",
+	"l.facebook.com":  "u",
+	"out.reddit.com":  "url",
+}
+
+// shortenerHosts are resolved with a HEAD request by ResolveLinks.
+var shortenerHosts = map[string]bool{
+	"bit.ly":               true,
+	"goo.gl":               true,
+	"ow.ly":                true,
+	"t.co":                 true,
+	"tinyurl.com":          true,
+	"feedproxy.google.com": true,
+	"feeds.feedburner.com": true,
+}
+
+// resolveTimeout bounds every connection of the HEAD requests of
+// ResolveLinks, so a host that does not answer cannot stall a fetch.
+const resolveTimeout = 10 * time.Second
+
+var resolveClient = &http.Client{
+	Transport: &http.Transport{
+		Dial: func(network, address string) (net.Conn, error) {
+			var conn, err = net.DialTimeout(network, address, resolveTimeout)
+
+			if err != nil {
+				return nil, err
+			}
+
+			conn.SetDeadline(time.Now().Add(resolveTimeout))
+
+			return conn, nil
+		},
+		DisableKeepAlives: true,
+	},
+}
+
+var linkChoosers = map[string]LinkChooser{
+	"default":  DefaultLink,
+	"guid":     GuidLink,
+	"origlink": OrigLink,
+}
+
+var linkModifiers = map[string]func(LinkChooser) LinkChooser{
+	"unwrap":  UnwrapLinks,
+	"resolve": ResolveLinks,
+}
+
+func DefaultLink(item *Item) string {
+	return item.Link
+}
+
+// GuidLink prefers the guid of an item if it is a permalink.
+func GuidLink(item *Item) string {
+	if item.Guid.IsPermaLink != "false" && isHttpUrl(item.Guid.Value) {
+		return strings.TrimSpace(item.Guid.Value)
+	}
+
+	return item.Link
+}
+
+// OrigLink prefers the original link FeedBurner stores next to its proxy link.
+func OrigLink(item *Item) string {
+	if isHttpUrl(item.OrigLink) {
+		return strings.TrimSpace(item.OrigLink)
+	}
+
+	return item.Link
+}
+
+// UnwrapLinks removes known redirect wrappers and utm_ tracking parameters
+// from the links chosen by chooser.
+func UnwrapLinks(chooser LinkChooser) LinkChooser {
+	return func(item *Item) string {
+		return unwrapLink(chooser(item))
+	}
+}
+
+// ResolveLinks follows the redirects of links to known shorteners with a
+// HEAD request. Resolved links are cached.
+func ResolveLinks(chooser LinkChooser) LinkChooser {
+	var mutex sync.Mutex
+	var resolved = make(map[string]string)
+
+	return func(item *Item) string {
+		var link = chooser(item)
+		var u, err = url.Parse(link)
+
+		if err != nil || !shortenerHosts[u.Host] {
+			return link
+		}
+
+		mutex.Lock()
+		var target, ok = resolved[link]
+		mutex.Unlock()
+
+		if ok {
+			return target
+		}
+
+		response, err := resolveClient.Head(link)
+
+		if err != nil {
+			return link
+		}
+
+		response.Body.Close()
+		target = response.Request.URL.String()
+
+		mutex.Lock()
+		resolved[link] = target
+		mutex.Unlock()
+
+		return target
+	}
+}
+
+// ParseLinkChooser builds a LinkChooser from a specification like
+// "origlink+unwrap+resolve": a base chooser followed by modifiers.
+func ParseLinkChooser(spec string) (LinkChooser, error) {
+	if spec == "" {
+		return DefaultLink, nil
+	}
+
+	var parts = strings.Split(spec, "+")
+	var chooser, ok = linkChoosers[parts[0]]
+
+	if !ok {
+		return nil, errors.New("Unknown link chooser " + parts[0])
+	}
+
+	for _, name := range parts[1:] {
+		var modifier, ok = linkModifiers[name]
+
+		if !ok {
+			return nil, errors.New("Unknown link modifier " + name)
+		}
+
+		chooser = modifier(chooser)
+	}
+
+	return chooser, nil
+}
+
+func unwrapLink(link string) string {
+	var u, err = url.Parse(link)
+
+	if err != nil {
+		return link
+	}
+
+	if param, ok := linkWrappers[u.Host]; ok {
+		if target := u.Query().Get(param); isHttpUrl(target) {
+			return unwrapLink(target)
+		}
+	}
+
+	var query = u.Query()
+	var tracked = false
+
+	for key := range query {
+		if strings.HasPrefix(key, "utm_") {
+			query.Del(key)
+			tracked = true
+		}
+	}
+
+	if !tracked {
+		return link
+	}
+
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+func isHttpUrl(link string) bool {
+	link = strings.TrimSpace(link)
+
+	return strings.HasPrefix(link, "http://") || strings.HasPrefix(link, "https://")
+}
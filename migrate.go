@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+)
+
+// A Migration changes the format of stored articles. Up converts an
+// article of the previous version, Down converts it back and is nil if
+// that is not possible. Both return whether they changed the article.
+type Migration struct {
+	Name string
+	Up   func(a *Article) (bool, error)
+	Down func(a *Article) (bool, error)
+}
+
+// migrations are numbered from 1 by their position. Articles store the
+// number of the last one applied in Schema, the store the number of the
+// last one completed under the checkpoint "schema".
+var migrations = []*Migration{
+	{"site-data-to-website-raw", siteDataToWebsiteRaw, websiteRawToSiteData},
+}
+
+// currentSchema is the Schema of articles stored now.
+func currentSchema() int {
+	return len(migrations)
+}
+
+// siteDataToWebsiteRaw moves the page from SiteData, base64 encoded and
+// zlib compressed, to WebsiteRaw. If there is a WebsiteRaw already, it was
+// extracted from SiteData by compact and SiteData is dropped.
+func siteDataToWebsiteRaw(a *Article) (bool, error) {
+	if a.SiteData == nil {
+		return false, nil
+	}
+
+	if a.WebsiteRaw == nil && a.WebsiteHash == "" {
+		var site, err = a.Site()
+
+		if err != nil && err != ErrNoData {
+			return false, err
+		}
+
+		if err == nil {
+			defer site.Close()
+
+			if err := a.SetWebsite(site); err != nil {
+				return false, err
+			}
+
+			a.FromSite = true
+		}
+	}
+
+	a.SiteData = nil
+
+	return true, nil
+}
+
+// websiteRawToSiteData restores the format of SiteData for the pages
+// siteDataToWebsiteRaw moved. Pages stored since and the text compact
+// extracted stay as they are.
+func websiteRawToSiteData(a *Article) (bool, error) {
+	if !a.FromSite {
+		return false, nil
+	}
+
+	var website, err = a.Website()
+
+	if err == ErrNoWebsite {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	defer website.Close()
+
+	var buffer = new(bytes.Buffer)
+	var encoder = base64.NewEncoder(base64.StdEncoding, buffer)
+	var writer = zlib.NewWriter(encoder)
+
+	if _, err := io.Copy(writer, website); err != nil {
+		return false, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return false, err
+	}
+
+	if err := encoder.Close(); err != nil {
+		return false, err
+	}
+
+	a.SiteData = &struct {
+		Data       []byte
+		Compressed bool
+	}{buffer.Bytes(), true}
+	a.WebsiteRaw = nil
+	a.WebsiteHash = ""
+	a.FromSite = false
+
+	return true, nil
+}
+
+// MigrationReport counts the articles a migration step looked at. Articles
+// that did not need a change still get their Schema updated.
+type MigrationReport struct {
+	Version int
+	Name    string
+	Up      bool
+	Read    int
+	Changed int
+	Failed  int
+}
+
+func (r *MigrationReport) String() string {
+	var direction = "up"
+
+	if !r.Up {
+		direction = "down"
+	}
+
+	return fmt.Sprintf("%d %s %s: %d read, %d changed, %d failed",
+		r.Version, r.Name, direction, r.Read, r.Changed, r.Failed)
+}
+
+// SchemaVersion returns the number of the last migration completed on
+// store.
+func SchemaVersion(store ArticleStore) (int, error) {
+	var version, err = store.Checkpoint("schema")
+
+	if err != nil || version == "" {
+		return 0, err
+	}
+
+	return strconv.Atoi(version)
+}
+
+// Migrate applies or rolls back migrations until store is at version. An
+// interrupted run continues where it stopped. With dryRun set, nothing is
+// written and the reports tell what would change.
+func Migrate(store ArticleStore, version int, dryRun bool) ([]*MigrationReport, error) {
+	if version < 0 || version > currentSchema() {
+		return nil, fmt.Errorf("No schema version %d, the current one is %d", version, currentSchema())
+	}
+
+	var current, err = SchemaVersion(store)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []*MigrationReport
+
+	for current != version {
+		var up = current < version
+		var step = current + 1
+
+		if !up {
+			step = current
+		}
+
+		var m = migrations[step-1]
+
+		if !up && m.Down == nil {
+			return reports, fmt.Errorf("Migration %d %s cannot be rolled back", step, m.Name)
+		}
+
+		var report, err = migrateStep(store, step, up, dryRun)
+		reports = append(reports, report)
+
+		if err != nil {
+			return reports, err
+		}
+
+		if dryRun {
+			// Later steps would see the articles unchanged.
+			break
+		}
+
+		if up {
+			current = step
+		} else {
+			current = step - 1
+		}
+
+		if err := store.SetCheckpoint("schema", strconv.Itoa(current)); err != nil {
+			return reports, err
+		}
+	}
+
+	return reports, nil
+}
+
+// migrateStep applies migration step to every article that needs it.
+func migrateStep(store ArticleStore, step int, up, dryRun bool) (*MigrationReport, error) {
+	var m = migrations[step-1]
+	var report = &MigrationReport{Version: step, Name: m.Name, Up: up}
+	var convert, name = m.Up, fmt.Sprintf("migrate-%d-up", step)
+
+	if !up {
+		convert, name = m.Down, fmt.Sprintf("migrate-%d-down", step)
+	}
+
+	var batches, err = NewBatchIterator(store, name, AllArticles, batchSize)
+
+	if err != nil {
+		return report, err
+	}
+
+	for {
+		var batch, err = batches.Next()
+
+		if err != nil {
+			return report, err
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var updated []*Article
+
+		for _, a := range batch {
+			if up && a.Schema >= step || !up && a.Schema < step {
+				continue
+			}
+
+			report.Read++
+
+			var changed, err = convert(a)
+
+			if err != nil {
+				log.Printf("Error migrating %x %v", a.Id, err)
+				report.Failed++
+				continue
+			}
+
+			if changed {
+				report.Changed++
+			}
+
+			if up {
+				a.Schema = step
+			} else {
+				a.Schema = step - 1
+			}
+
+			updated = append(updated, a)
+		}
+
+		if dryRun {
+			continue
+		}
+
+		var result *BatchResult
+
+		if len(updated) > 0 {
+			if result, err = store.UpdateBatch(updated); err != nil {
+				return report, err
+			}
+
+			logFailed(result)
+			report.Failed += len(result.Failed)
+		}
+
+		if err := batches.Commit(result); err != nil {
+			return report, err
+		}
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	// The next run in this direction has to start over.
+	if err := batches.Restart(); err != nil {
+		return report, err
+	}
+
+	if report.Failed > 0 {
+		return report, errors.New(report.String())
+	}
+
+	return report, nil
+}
+
+// migrate brings the stores of sources to the current or the -to schema
+// version.
+func migrate(args []string) {
+	var flags = flag.NewFlagSet("migrate", flag.ExitOnError)
+	var to = flags.Int("to", currentSchema(), "schema version to migrate to, lower ones roll back")
+	var dryRun = flags.Bool("dry-run", false, "only report what the next step would change")
+	var list = flags.Bool("list", false, "list the migrations and the version of every source")
+
+	flags.Parse(args)
+
+	if *list {
+		for i, m := range migrations {
+			var down = ""
+
+			if m.Down == nil {
+				down = " (no rollback)"
+			}
+
+			fmt.Printf("%d %s%s\n", i+1, m.Name, down)
+		}
+	}
+
+	for _, name := range flags.Args() {
+		var store, err = OpenStore(name)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if *list {
+			version, err := SchemaVersion(store)
+
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			fmt.Println(name, "at version", version)
+			continue
+		}
+
+		reports, err := Migrate(store, *to, *dryRun)
+
+		for _, report := range reports {
+			log.Println(name, report)
+		}
+
+		if err != nil {
+			log.Fatal(name, ": ", err)
+		}
+	}
+}
+
+// MergeSource copies the articles and feeds of the database of a source to
+// the -unified database. An interrupted merge continues where it stopped,
+// articles merged before are replaced by their copy in the source database.
+func MergeSource(name string) error {
+	if config.Unified == "" {
+		return errors.New("No unified database to merge into, set one with -unified")
+	}
+
+	if name == config.Unified {
+		return errors.New("Cannot merge the unified database " + name + " into itself")
+	}
+
+	if _, err := connect(name); err != nil {
+		return err
+	}
+
+	var from = NewMongoStore(name)
+	var to, err = OpenStore(name)
+
+	if err != nil {
+		return err
+	}
+
+	batches, err := NewBatchIterator(from, "merge", AllArticles, batchSize)
+
+	if err != nil {
+		return err
+	}
+
+	var merged = 0
+
+	for {
+		var batch, err = batches.Next()
+
+		if err != nil {
+			return err
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		result, err := to.UpdateBatch(batch)
+
+		if err != nil {
+			return err
+		}
+
+		if err := result.Err(); err != nil {
+			logFailed(result)
+			return err
+		}
+
+		if err := batches.Commit(result); err != nil {
+			return err
+		}
+
+		merged += len(batch)
+		log.Println(name, "merged", merged, "articles")
+	}
+
+	if err := mergeSchemaVersion(from, to); err != nil {
+		return err
+	}
+
+	var feeds = 0
+	var iter = ArchivedFeeds(name, "")
+	var feed = new(ArchivedFeed)
+
+	for iter.Next(feed) {
+		feed.Source = name
+
+		if err := MergeArchivedFeed(config.Unified, feed); err != nil {
+			iter.Close()
+			return err
+		}
+
+		feeds++
+		feed = new(ArchivedFeed)
+	}
+
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	log.Println(name, "merged", feeds, "feeds")
+
+	return nil
+}
+
+// mergeSchemaVersion keeps the older schema version of from and to, so
+// migrations still run on the merged articles.
+func mergeSchemaVersion(from, to ArticleStore) error {
+	var version, err = SchemaVersion(from)
+
+	if err != nil {
+		return err
+	}
+
+	current, err := to.Checkpoint("schema")
+
+	if err != nil {
+		return err
+	}
+
+	if current != "" {
+		if v, err := strconv.Atoi(current); err == nil && v <= version {
+			return nil
+		}
+	}
+
+	return to.SetCheckpoint("schema", strconv.Itoa(version))
+}
+
+// merge copies sources, by default all that are crawled, to the -unified
+// database.
+func merge(args []string) {
+	var flags = flag.NewFlagSet("merge", flag.ExitOnError)
+
+	flags.Parse(args)
+
+	var names = flags.Args()
+
+	if len(names) == 0 {
+		for name := range sourceFeeds {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		if err := MergeSource(name); err != nil {
+			log.Fatal(name, ": ", err)
+		}
+	}
+}
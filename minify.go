@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"exp/html"
+	"flag"
+	"io"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+type MinifyConfig struct {
+	// Remove lists the elements to drop besides scripts, styles, comments
+	// and tracking pixels, as tag, #id, .class or combinations like
+	// div.ad.
+	Remove []string `json:"remove"`
+}
+
+// Minifier strips what we never read from pages before they are stored.
+type Minifier struct {
+	remove []selector
+}
+
+type selector struct {
+	tag     string
+	id      string
+	classes []string
+}
+
+func parseSelector(s string) (selector, error) {
+	var sel selector
+
+	if strings.ContainsAny(s, " >[]:") {
+		return sel, errors.New("Unsupported selector " + s)
+	}
+
+	// Every part runs up to the next # or ., the first one is the tag.
+	var kind, start = byte(0), 0
+
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && s[i] != '#' && s[i] != '.' {
+			continue
+		}
+
+		var part = s[start:i]
+
+		switch {
+		case kind == 0:
+			sel.tag = strings.ToLower(part)
+		case part == "" || kind == '#' && sel.id != "":
+			return sel, errors.New("Invalid selector " + s)
+		case kind == '#':
+			sel.id = part
+		default:
+			sel.classes = append(sel.classes, part)
+		}
+
+		if i < len(s) {
+			kind, start = s[i], i+1
+		}
+	}
+
+	if sel.tag == "" && sel.id == "" && len(sel.classes) == 0 {
+		return sel, errors.New("Empty selector " + s)
+	}
+
+	return sel, nil
+}
+
+func (sel selector) match(n *html.Node) bool {
+	if sel.tag != "" && n.Data != sel.tag {
+		return false
+	}
+
+	var id, classes = "", make(map[string]bool)
+
+	for _, a := range n.Attr {
+		switch a.Key {
+		case "id":
+			id = a.Val
+		case "class":
+			for _, class := range strings.Fields(a.Val) {
+				classes[class] = true
+			}
+		}
+	}
+
+	if sel.id != "" && id != sel.id {
+		return false
+	}
+
+	for _, class := range sel.classes {
+		if !classes[class] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// NewMinifier returns a Minifier that also removes the elements of c,
+// which may be nil.
+func NewMinifier(c *MinifyConfig) (*Minifier, error) {
+	var m = new(Minifier)
+
+	if c == nil {
+		return m, nil
+	}
+
+	for _, s := range c.Remove {
+		var sel, err = parseSelector(s)
+
+		if err != nil {
+			return nil, err
+		}
+
+		m.remove = append(m.remove, sel)
+	}
+
+	return m, nil
+}
+
+// Minify returns page without scripts, styles, comments, tracking pixels
+// and the configured elements, with runs of whitespace collapsed outside of
+// pre and textarea elements. Pages not in UTF-8 are returned as they are,
+// the parser would garble them.
+func (m *Minifier) Minify(page []byte) ([]byte, error) {
+	if !isUTF8(page) {
+		return page, nil
+	}
+
+	var root, err = html.Parse(bytes.NewReader(page))
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.clean(root, false)
+
+	var buffer = new(bytes.Buffer)
+
+	if err := html.Render(buffer, root); err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func (m *Minifier) clean(n *html.Node, preformatted bool) {
+	var kept []*html.Node
+
+	for _, c := range n.Child {
+		if m.drop(c) {
+			c.Parent = nil
+			continue
+		}
+
+		if c.Type == html.TextNode && !preformatted {
+			c.Data = collapseSpace(c.Data)
+
+			if c.Data == "" {
+				continue
+			}
+		}
+
+		m.clean(c, preformatted || c.Type == html.ElementNode && (c.Data == "pre" || c.Data == "textarea"))
+		kept = append(kept, c)
+	}
+
+	n.Child = kept
+}
+
+func (m *Minifier) drop(n *html.Node) bool {
+	switch n.Type {
+	case html.CommentNode:
+		return true
+	case html.ElementNode:
+	default:
+		return false
+	}
+
+	switch n.Data {
+	case "script", "style":
+		return true
+	case "img":
+		if isTrackingPixel(n) {
+			return true
+		}
+	}
+
+	for _, sel := range m.remove {
+		if sel.match(n) {
+			return true
+		}
+	}
+
+	return false
+}
+
+var metaCharsetRex = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([a-z0-9_:.-]+)`)
+
+// isUTF8 reports whether page is valid UTF-8 and declares no other charset.
+func isUTF8(page []byte) bool {
+	var start = page
+
+	if len(start) > 1024 {
+		start = start[:1024]
+	}
+
+	if m := metaCharsetRex.FindSubmatch(start); m != nil {
+		var charset = strings.ToLower(string(m[1]))
+
+		if charset != "utf-8" && charset != "utf8" {
+			return false
+		}
+	}
+
+	return utf8.Valid(page)
+}
+
+// isTrackingPixel reports whether an img is at most one pixel in size.
+func isTrackingPixel(n *html.Node) bool {
+	var width, height string
+
+	for _, a := range n.Attr {
+		switch a.Key {
+		case "width":
+			width = strings.TrimSpace(a.Val)
+		case "height":
+			height = strings.TrimSpace(a.Val)
+		}
+	}
+
+	var tiny = func(s string) bool {
+		return s == "0" || s == "1" || s == "0px" || s == "1px"
+	}
+
+	return tiny(width) && tiny(height)
+}
+
+// collapseSpace replaces runs of whitespace with a single space.
+func collapseSpace(s string) string {
+	var buffer = new(bytes.Buffer)
+	var space = false
+
+	for _, r := range s {
+		switch r {
+		case ' ', '\t', '\n', '\r', '\f':
+			space = true
+			continue
+		}
+
+		if space {
+			buffer.WriteByte(' ')
+			space = false
+		}
+
+		buffer.WriteRune(r)
+	}
+
+	if space {
+		buffer.WriteByte(' ')
+	}
+
+	return buffer.String()
+}
+
+// MinifyStats counts the bytes minification saved for a source.
+type MinifyStats struct {
+	Pages  int
+	Before int
+	After  int
+}
+
+var (
+	minifyMutex sync.Mutex
+	minifiers   = make(map[string]*Minifier)
+	minifyStats = make(map[string]*MinifyStats)
+)
+
+// sourceMinifier returns the Minifier of a source, nil if it does not
+// minify its pages.
+func sourceMinifier(source string) (*Minifier, error) {
+	var c = config.Source(source).Minify
+
+	if c == nil {
+		return nil, nil
+	}
+
+	minifyMutex.Lock()
+	defer minifyMutex.Unlock()
+
+	if m, ok := minifiers[source]; ok {
+		return m, nil
+	}
+
+	var m, err = NewMinifier(c)
+
+	if err != nil {
+		return nil, err
+	}
+
+	minifiers[source] = m
+
+	return m, nil
+}
+
+func recordMinify(source string, before, after int) {
+	minifyMutex.Lock()
+	defer minifyMutex.Unlock()
+
+	var stats, ok = minifyStats[source]
+
+	if !ok {
+		stats = new(MinifyStats)
+		minifyStats[source] = stats
+	}
+
+	stats.Pages++
+	stats.Before += before
+	stats.After += after
+}
+
+// logMinifyStats logs the bytes saved per source so far.
+func logMinifyStats() {
+	minifyMutex.Lock()
+	defer minifyMutex.Unlock()
+
+	var sources []string
+
+	for source := range minifyStats {
+		sources = append(sources, source)
+	}
+
+	sort.Strings(sources)
+
+	for _, source := range sources {
+		var s = minifyStats[source]
+		log.Printf("%s: minified %d pages from %d to %d bytes, %d saved",
+			source, s.Pages, s.Before, s.After, s.Before-s.After)
+	}
+}
+
+// isHTML reports whether page is an html document. The text compact
+// extracted and other files are not minified.
+func isHTML(page []byte) bool {
+	var start = page
+
+	if len(start) > 1024 {
+		start = start[:1024]
+	}
+
+	start = bytes.ToLower(start)
+
+	return bytes.Contains(start, []byte("<html")) || bytes.Contains(start, []byte("<!doctype html"))
+}
+
+// StorePage sets the page of a, minified if the source is configured to
+// and compressed with the newest dictionary of the source. With dedup set
+// for the source it goes to the shared blob store, the caller owns the
+// reference to it.
+func StorePage(source string, a *Article, page io.Reader) error {
+	var m, err = sourceMinifier(source)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadAll(page)
+
+	if err != nil {
+		return err
+	}
+
+	if m != nil && isHTML(data) {
+		var minified, err = m.Minify(data)
+
+		if err != nil {
+			return err
+		}
+
+		if len(minified) < len(data) {
+			recordMinify(source, len(data), len(minified))
+			data = minified
+		}
+	}
+
+	dict, err := LatestDictionary(source)
+
+	if err != nil {
+		return err
+	}
+
+	if !config.Source(source).Dedup {
+		return a.CompressWebsite(bytes.NewReader(data), dict)
+	}
+
+	hash, err := putBlob(data, dict)
+
+	if err != nil {
+		return err
+	}
+
+	a.WebsiteRaw, a.WebsiteHash = nil, hash
+
+	return nil
+}
+
+// minify minifies the pages already stored for sources, with the elements
+// of their configuration removed if there is one.
+func minify(args []string) {
+	var flags = flag.NewFlagSet("minify", flag.ExitOnError)
+	var restart = flags.Bool("restart", false, "start again with the first article instead of the checkpoint")
+
+	flags.Parse(args)
+
+	for _, name := range flags.Args() {
+		if err := MinifyStored(name, *restart); err != nil {
+			log.Fatal(name, ": ", err)
+		}
+	}
+
+	logMinifyStats()
+}
+
+// MinifyStored minifies the stored html pages of a source, leaving the text
+// compact extracted alone. Only pages that get smaller are written and
+// counted.
+func MinifyStored(name string, restart bool) error {
+	var store, err = OpenStore(name)
+
+	if err != nil {
+		return err
+	}
+
+	m, err := NewMinifier(config.Source(name).Minify)
+
+	if err != nil {
+		return err
+	}
+
+	dict, err := LatestDictionary(name)
+
+	if err != nil {
+		return err
+	}
+
+	batches, err := NewBatchIterator(store, "minify", AllArticles, batchSize)
+
+	if err != nil {
+		return err
+	}
+
+	if restart {
+		if err := batches.Restart(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var batch, err = batches.Next()
+
+		if err != nil {
+			return err
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var changed []*Article
+		var put = make(map[string]bool)
+
+		for _, a := range batch {
+			var page, err = articlePage(a)
+
+			if err != nil {
+				log.Printf("Error reading page of %x %v", a.Id, err)
+				continue
+			}
+
+			if page == nil || a.WebsiteRaw == nil && a.WebsiteHash == "" || !isHTML(page) {
+				continue
+			}
+
+			if codec, _, _ := PageCodec(a.WebsiteRaw); a.WebsiteRaw != nil && codec == codecFlateText {
+				continue
+			}
+
+			minified, err := m.Minify(page)
+
+			if err != nil {
+				log.Printf("Error minifying page of %x %v", a.Id, err)
+				continue
+			}
+
+			if len(minified) >= len(page) {
+				continue
+			}
+
+			recordMinify(name, len(page), len(minified))
+
+			if a.WebsiteHash != "" {
+				// The store releases the blob of the page replaced.
+				if a.WebsiteHash, err = putBlob(minified, dict); err != nil {
+					return err
+				}
+
+				put[a.Id] = true
+			} else if err := a.CompressWebsite(bytes.NewReader(minified), dict); err != nil {
+				return err
+			}
+
+			changed = append(changed, a)
+		}
+
+		var result *BatchResult
+
+		if len(changed) > 0 {
+			if result, err = store.UpdateWebsiteBatch(changed); err != nil {
+				return err
+			}
+
+			logFailed(result)
+
+			for _, a := range changed {
+				if _, failed := result.Failed[a.Id]; failed && put[a.Id] {
+					if err := releaseBlob(a.WebsiteHash); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if err := batches.Commit(result); err != nil {
+			return err
+		}
+	}
+
+	return batches.Restart()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"exp/html"
+	"reflect"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	var tests = []struct {
+		s    string
+		want selector
+		ok   bool
+	}{
+		{"div", selector{tag: "div"}, true},
+		{"DIV", selector{tag: "div"}, true},
+		{"#top", selector{id: "top"}, true},
+		{".ad", selector{classes: []string{"ad"}}, true},
+		{"div.ad.wide", selector{tag: "div", classes: []string{"ad", "wide"}}, true},
+		{"aside#teaser.ad", selector{tag: "aside", id: "teaser", classes: []string{"ad"}}, true},
+		{"", selector{}, false},
+		{"div.", selector{}, false},
+		{"#a#b", selector{}, false},
+		{"div .ad", selector{}, false},
+		{"div > p", selector{}, false},
+		{"a[href]", selector{}, false},
+	}
+
+	for _, test := range tests {
+		var got, err = parseSelector(test.s)
+
+		if (err == nil) != test.ok {
+			t.Errorf("parseSelector(%q) error %v", test.s, err)
+			continue
+		}
+
+		if test.ok && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseSelector(%q) = %+v, want %+v", test.s, got, test.want)
+		}
+	}
+}
+
+func TestCollapseSpace(t *testing.T) {
+	var tests = []struct {
+		s, want string
+	}{
+		{"", ""},
+		{"a", "a"},
+		{"  a  ", " a "},
+		{"a \t\n\r\f b", "a b"},
+		{"\n\nGrüezi\n  mitenand", " Grüezi mitenand"},
+		{"a\u00a0 b", "a\u00a0 b"},
+	}
+
+	for _, test := range tests {
+		if got := collapseSpace(test.s); got != test.want {
+			t.Errorf("collapseSpace(%q) = %q, want %q", test.s, got, test.want)
+		}
+	}
+}
+
+func TestIsTrackingPixel(t *testing.T) {
+	var tests = []struct {
+		width, height string
+		want          bool
+	}{
+		{"1", "1", true},
+		{"0", "0", true},
+		{" 1px", "1px ", true},
+		{"1", "", false},
+		{"", "", false},
+		{"1", "10", false},
+		{"100", "100", false},
+	}
+
+	for _, test := range tests {
+		var img = &html.Node{Type: html.ElementNode, Data: "img"}
+
+		if test.width != "" {
+			img.Attr = append(img.Attr, html.Attribute{Key: "width", Val: test.width})
+		}
+
+		if test.height != "" {
+			img.Attr = append(img.Attr, html.Attribute{Key: "height", Val: test.height})
+		}
+
+		if got := isTrackingPixel(img); got != test.want {
+			t.Errorf("isTrackingPixel(%q, %q) = %v, want %v", test.width, test.height, got, test.want)
+		}
+	}
+}
+
+func TestMinify(t *testing.T) {
+	var m, err = NewMinifier(&MinifyConfig{Remove: []string{"div.ad", "#teaser"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name, page, want string
+	}{
+		{
+			"scripts",
+			"<html><head><title>T</title><script>x()</script><style>p{}</style></head><body><!-- c --><p>A</p></body></html>",
+			"<html><head><title>T</title></head><body><p>A</p></body></html>",
+		},
+		{
+			"whitespace",
+			"<html><body>\n  <p>A   \n B</p>\n  </body></html>",
+			"<html><head></head><body> <p>A B</p> </body></html>",
+		},
+		{
+			"pre and textarea",
+			"<html><body><pre>a  \n  b</pre><textarea>c\n\n  d</textarea></body></html>",
+			"<html><head></head><body><pre>a  \n  b</pre><textarea>c\n\n  d</textarea></body></html>",
+		},
+		{
+			"selectors",
+			"<html><body><div class=\"box\nad\">x</div><div class=\"box\">y</div><p id=\"teaser\">z</p></body></html>",
+			"<html><head></head><body><div class=\"box\">y</div></body></html>",
+		},
+		{
+			"pixels",
+			"<html><body><img src=\"a.gif\" width=\"1\" height=\"1\"><img src=\"b.jpg\" width=\"100\" height=\"50\"></body></html>",
+			"<html><head></head><body><img src=\"b.jpg\" width=\"100\" height=\"50\"/></body></html>",
+		},
+		{
+			"latin1",
+			"<html><head><meta charset=\"iso-8859-1\"><script>x()</script></head><body><p>Z\xfcrich</p></body></html>",
+			"<html><head><meta charset=\"iso-8859-1\"><script>x()</script></head><body><p>Z\xfcrich</p></body></html>",
+		},
+		{
+			"invalid utf-8",
+			"<html><body><script>x()</script><p>Z\xfcrich</p></body></html>",
+			"<html><body><script>x()</script><p>Z\xfcrich</p></body></html>",
+		},
+	}
+
+	for _, test := range tests {
+		var got, err = m.Minify([]byte(test.page))
+
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		if string(got) != test.want {
+			t.Errorf("%s: Minify = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"launchpad.net/mgo/bson"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebsiteStatus tells where the page of an article is stored.
+type WebsiteStatus string
+
+const (
+	// WebsiteNone selects articles without a page.
+	WebsiteNone WebsiteStatus = "none"
+	// WebsiteAny selects articles with a page in either format.
+	WebsiteAny WebsiteStatus = "any"
+	// WebsiteLegacy selects articles that still have SiteData.
+	WebsiteLegacy WebsiteStatus = "legacy"
+	// WebsiteStored selects articles with WebsiteRaw or a page in the blob
+	// store or the cold archive.
+	WebsiteStored WebsiteStatus = "raw"
+)
+
+// The fields results can be sorted by, a leading - sorts descending.
+var sortFields = map[string]bool{"pubDate": true, "firstSeen": true, "title": true}
+
+// Query selects articles. Build it with NewQuery and the setters, then run
+// it with FindArticles or the Find method of a store. Stores hold one
+// source each, so they ignore Source, FindArticles uses it to pick the
+// store.
+type Query struct {
+	source  string
+	from    time.Time
+	to      time.Time
+	section string
+	title   string
+	website WebsiteStatus
+	sort    string
+	limit   int
+	// quarantined also selects the articles verify set aside.
+	quarantined bool
+}
+
+func NewQuery() *Query {
+	return new(Query)
+}
+
+func (q *Query) Source(source string) *Query {
+	q.source = source
+	return q
+}
+
+// Between selects articles published at or after from and before to. A
+// zero time leaves that end open.
+func (q *Query) Between(from, to time.Time) *Query {
+	q.from, q.to = from, to
+	return q
+}
+
+func (q *Query) Section(section string) *Query {
+	q.section = section
+	return q
+}
+
+// TitleContains selects articles whose title contains s, ignoring case.
+func (q *Query) TitleContains(s string) *Query {
+	q.title = s
+	return q
+}
+
+func (q *Query) Website(status WebsiteStatus) *Query {
+	q.website = status
+	return q
+}
+
+// SortBy orders the results by one of sortFields, "-pubDate" puts the
+// newest first. Without it the order is the storage order.
+func (q *Query) SortBy(field string) *Query {
+	q.sort = field
+	return q
+}
+
+// Quarantined also selects the articles set aside by verify, which are
+// left out otherwise.
+func (q *Query) Quarantined() *Query {
+	q.quarantined = true
+	return q
+}
+
+// Limit returns at most n articles, 0 returns all.
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// Validate checks the sort field and website status.
+func (q *Query) Validate() error {
+	if q.sort != "" && !sortFields[strings.TrimLeft(q.sort, "-")] {
+		return errors.New("Cannot sort by " + q.sort)
+	}
+
+	switch q.website {
+	case "", WebsiteNone, WebsiteAny, WebsiteLegacy, WebsiteStored:
+	default:
+		return errors.New("Unknown website status " + string(q.website))
+	}
+
+	if q.limit < 0 {
+		return errors.New("Negative limit")
+	}
+
+	return nil
+}
+
+// Match reports whether a is selected by q, apart from its source.
+func (q *Query) Match(a *Article) bool {
+	if a.Quarantine != "" && !q.quarantined {
+		return false
+	}
+
+	if !q.from.IsZero() && a.PubDate.Before(q.from) {
+		return false
+	}
+
+	if !q.to.IsZero() && !a.PubDate.Before(q.to) {
+		return false
+	}
+
+	if q.section != "" && a.Section != q.section {
+		return false
+	}
+
+	if q.title != "" && !strings.Contains(strings.ToLower(a.Title), strings.ToLower(q.title)) {
+		return false
+	}
+
+	var legacy, stored = a.SiteData != nil, a.WebsiteRaw != nil || a.WebsiteHash != "" || a.Cold != nil
+
+	switch q.website {
+	case WebsiteNone:
+		return !legacy && !stored
+	case WebsiteAny:
+		return legacy || stored
+	case WebsiteLegacy:
+		return legacy
+	case WebsiteStored:
+		return stored
+	}
+
+	return true
+}
+
+// bson returns the mongo query selecting the articles matched by q.
+func (q *Query) bson() bson.M {
+	var query = bson.M{}
+
+	if !q.from.IsZero() || !q.to.IsZero() {
+		var pubDate = bson.M{}
+
+		if !q.from.IsZero() {
+			pubDate["$gte"] = q.from
+		}
+
+		if !q.to.IsZero() {
+			pubDate["$lt"] = q.to
+		}
+
+		query["pubDate"] = pubDate
+	}
+
+	if q.section != "" {
+		query["section"] = q.section
+	}
+
+	if q.title != "" {
+		query["title"] = bson.M{"$regex": regexp.QuoteMeta(q.title), "$options": "i"}
+	}
+
+	if !q.quarantined {
+		query["quarantine"] = bson.M{"$exists": false}
+	}
+
+	// WebsiteRaw may be stored as null, only binary values count.
+	var stored = bson.M{"websiteraw": bson.M{"$type": 5}}
+	var blob = bson.M{"websiteHash": bson.M{"$exists": true}}
+	var cold = bson.M{"cold": bson.M{"$exists": true}}
+	var legacy = bson.M{"site": bson.M{"$exists": true}}
+
+	switch q.website {
+	case WebsiteNone:
+		query["websiteraw"] = bson.M{"$not": bson.M{"$type": 5}}
+		query["websiteHash"] = bson.M{"$exists": false}
+		query["cold"] = bson.M{"$exists": false}
+		query["site"] = bson.M{"$exists": false}
+	case WebsiteAny:
+		query["$or"] = []bson.M{stored, blob, cold, legacy}
+	case WebsiteLegacy:
+		query["site"] = legacy["site"]
+	case WebsiteStored:
+		query["$or"] = []bson.M{stored, blob, cold}
+	}
+
+	return query
+}
+
+// sortArticles orders articles as q asks for.
+func (q *Query) sortArticles(articles []*Article) {
+	if q.sort == "" {
+		return
+	}
+
+	sort.Sort(&articleSorter{articles, strings.TrimLeft(q.sort, "-"), strings.HasPrefix(q.sort, "-")})
+}
+
+type articleSorter struct {
+	articles   []*Article
+	field      string
+	descending bool
+}
+
+func (s *articleSorter) Len() int {
+	return len(s.articles)
+}
+
+func (s *articleSorter) Swap(i, j int) {
+	s.articles[i], s.articles[j] = s.articles[j], s.articles[i]
+}
+
+func (s *articleSorter) Less(i, j int) bool {
+	if s.descending {
+		i, j = j, i
+	}
+
+	var a, b = s.articles[i], s.articles[j]
+
+	switch s.field {
+	case "firstSeen":
+		return a.FirstSeen.Before(b.FirstSeen)
+	case "title":
+		return a.Title < b.Title
+	}
+
+	return a.PubDate.Before(b.PubDate)
+}
+
+// FindArticles runs q on the store of its source. Without a source it runs
+// on the -unified database, or else on every crawled source, merging their
+// results in the sort order and limiting the merged results. The articles
+// have their Source set.
+func FindArticles(q *Query) (ArticleIter, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+
+	if q.source != "" {
+		return openSourceIter(q.source, q)
+	}
+
+	if config.Unified != "" && *storeDir == "" {
+		var store, err = OpenSharedStore()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return store.Find(q), nil
+	}
+
+	var names []string
+
+	for name := range sourceFeeds {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return newMultiIter(names, q)
+}
+
+func openSourceIter(name string, q *Query) (ArticleIter, error) {
+	var store, err = OpenStore(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &sourceIter{store.Find(q), name}, nil
+}
+
+// sourceIter sets the source of the articles of a store holding one.
+type sourceIter struct {
+	ArticleIter
+	source string
+}
+
+func (it *sourceIter) Next(a *Article) bool {
+	if !it.ArticleIter.Next(a) {
+		return false
+	}
+
+	if a.Source == "" {
+		a.Source = it.source
+	}
+
+	return true
+}
+
+// multiIter merges the results of a query on several sources. With a sort
+// field it returns the first of the next articles of the sources in that
+// order, otherwise the sources one after the other. The limit applies to
+// the merged results.
+type multiIter struct {
+	iters []ArticleIter
+	// heads are the next articles of iters, nil once one is exhausted.
+	heads    []*Article
+	started  bool
+	query    *Query
+	returned int
+	err      error
+}
+
+func newMultiIter(names []string, q *Query) (*multiIter, error) {
+	var it = &multiIter{query: q}
+
+	for _, name := range names {
+		var iter, err = openSourceIter(name, q)
+
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+
+		it.iters = append(it.iters, iter)
+	}
+
+	it.heads = make([]*Article, len(it.iters))
+
+	return it, nil
+}
+
+// advance reads the next article of the i-th source into its head.
+func (it *multiIter) advance(i int) {
+	var a = new(Article)
+
+	if it.iters[i].Next(a) {
+		it.heads[i] = a
+		return
+	}
+
+	it.heads[i] = nil
+
+	if err := it.iters[i].Err(); err != nil && it.err == nil {
+		it.err = err
+	}
+}
+
+func (it *multiIter) Next(a *Article) bool {
+	if it.query.limit > 0 && it.returned == it.query.limit {
+		return false
+	}
+
+	if !it.started {
+		for i := range it.iters {
+			it.advance(i)
+		}
+
+		it.started = true
+	}
+
+	if it.err != nil {
+		return false
+	}
+
+	var next = -1
+
+	for i, head := range it.heads {
+		if head == nil {
+			continue
+		}
+
+		if next == -1 {
+			next = i
+
+			if it.query.sort == "" {
+				break
+			}
+
+			continue
+		}
+
+		var sorter = &articleSorter{[]*Article{head, it.heads[next]}, strings.TrimLeft(it.query.sort, "-"), strings.HasPrefix(it.query.sort, "-")}
+
+		if sorter.Less(0, 1) {
+			next = i
+		}
+	}
+
+	if next == -1 {
+		return false
+	}
+
+	*a = *it.heads[next]
+	it.returned++
+	it.advance(next)
+
+	return true
+}
+
+func (it *multiIter) Err() error {
+	return it.err
+}
+
+func (it *multiIter) Close() error {
+	var err = it.err
+
+	for _, iter := range it.iters {
+		if closeErr := iter.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	it.iters, it.heads = nil, nil
+
+	return err
+}
+
+// ParseQuery reads a query from parameters named like the flags of the
+// query command: source, from, to (2006-01-02 or RFC 3339), section,
+// title, website, sort and limit.
+func ParseQuery(values url.Values) (*Query, error) {
+	var q = NewQuery().
+		Source(values.Get("source")).
+		Section(values.Get("section")).
+		TitleContains(values.Get("title")).
+		Website(WebsiteStatus(values.Get("website"))).
+		SortBy(values.Get("sort"))
+
+	var from, err = parseQueryTime(values.Get("from"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := parseQueryTime(values.Get("to"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	q.Between(from, to)
+
+	if limit := values.Get("limit"); limit != "" {
+		var n, err = strconv.Atoi(limit)
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid limit %q", limit)
+		}
+
+		q.Limit(n)
+	}
+
+	return q, q.Validate()
+}
+
+func parseQueryTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+
+	var t, err = time.Parse(time.RFC3339, value)
+
+	if err != nil {
+		return t, fmt.Errorf("Invalid time %q, use 2006-01-02 or RFC 3339", value)
+	}
+
+	return t, nil
+}
+
+// queryFlags are the flags of the query command, the parameters of
+// ParseQuery.
+var queryFlags = []struct{ name, value, usage string }{
+	{"source", "", "source to query, all if empty"},
+	{"from", "", "first publication date, like 2012-03-01"},
+	{"to", "", "publication date to stop before"},
+	{"section", "", "section, like schweiz"},
+	{"title", "", "text the title contains"},
+	{"website", "", "articles with page none, any, legacy or raw"},
+	{"sort", "", "pubDate, firstSeen or title, prefixed with - for descending"},
+	{"limit", "20", "maximum number of articles, 0 for all"},
+}
+
+// query prints the articles selected by the flags.
+func query(args []string) {
+	var flags = flag.NewFlagSet("query", flag.ExitOnError)
+	var asJson = flags.Bool("json", false, "print JSON lines instead of a table")
+	var values = make(map[string]*string)
+
+	for _, f := range queryFlags {
+		values[f.name] = flags.String(f.name, f.value, f.usage)
+	}
+
+	flags.Parse(args)
+
+	var params = make(url.Values)
+
+	for name, value := range values {
+		if *value != "" {
+			params.Set(name, *value)
+		}
+	}
+
+	var q, err = ParseQuery(params)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	iter, err := FindArticles(q)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var encoder = json.NewEncoder(os.Stdout)
+
+	for a := new(Article); iter.Next(a); a = new(Article) {
+		if *asJson {
+			encoder.Encode(toJsonArticle(a))
+		} else {
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n",
+				a.PubDate.Format("2006-01-02 15:04"), a.Source, a.Section, a.Title, a.Link)
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// QueryHandler answers GET requests with the articles selected by the
+// parameters of ParseQuery as JSON lines.
+type QueryHandler struct {
+	// MaxLimit caps the number of articles of one response.
+	MaxLimit int
+}
+
+func (h *QueryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET is supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var q, err = ParseQuery(r.URL.Query())
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if q.limit == 0 || q.limit > h.MaxLimit {
+		q.Limit(h.MaxLimit)
+	}
+
+	iter, err := FindArticles(q)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	var encoder = json.NewEncoder(w)
+
+	for a := new(Article); iter.Next(a); a = new(Article) {
+		if err := encoder.Encode(toJsonArticle(a)); err != nil {
+			break
+		}
+	}
+
+	if err := iter.Close(); err != nil {
+		log.Println("Error querying", r.URL, err)
+	}
+}
+
+// serve answers queries over HTTP at /articles.
+func serve(args []string) {
+	var flags = flag.NewFlagSet("serve", flag.ExitOnError)
+	var listen = flags.String("listen", ":8080", "address to listen on")
+	var maxLimit = flags.Int("max", 1000, "maximum number of articles per response")
+
+	flags.Parse(args)
+
+	http.Handle("/articles", &QueryHandler{*maxLimit})
+
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
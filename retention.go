@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+type RetentionConfig struct {
+	// HotDays is how long pages stay in the database after an article was
+	// first seen before they move to the cold archive.
+	HotDays int `json:"hotDays"`
+}
+
+var coldDir = flag.String("cold", "cold", "directory of the monthly archives of old pages")
+
+// ColdPage locates a page in the cold archive. File is relative to -cold,
+// the response record of the page is Length bytes at Offset.
+type ColdPage struct {
+	File   string
+	Offset int64
+	Length int64
+}
+
+// LoadColdPage returns the page of c.
+func LoadColdPage(c *ColdPage) (io.ReadCloser, error) {
+	var file, err = os.Open(filepath.Join(*coldDir, c.File))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	warc, err := NewWarcReader(io.NewSectionReader(file, c.Offset, c.Length))
+
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := warc.Next()
+
+	if err != nil {
+		return nil, fmt.Errorf("%s at %d: %v", c.File, c.Offset, err)
+	}
+
+	page, err := record.Page()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(page)), nil
+}
+
+// coldArchive appends pages to the monthly WARC files of a source.
+type coldArchive struct {
+	source string
+	files  map[string]*os.File
+}
+
+func newColdArchive(source string) *coldArchive {
+	return &coldArchive{source, make(map[string]*os.File)}
+}
+
+// month returns the archive file of the month articles first seen at date
+// go to, relative to -cold.
+func (c *coldArchive) month(date time.Time) string {
+	return filepath.Join(c.source, date.UTC().Format("2006-01")+".warc.gz")
+}
+
+// Put appends the page of a to the archive of its month.
+func (c *coldArchive) Put(a *Article, page []byte) (*ColdPage, error) {
+	var name = c.month(coldDate(a))
+	var file, ok = c.files[name]
+	var path = filepath.Join(*coldDir, name)
+
+	if !ok {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+
+		var err error
+
+		if file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return nil, err
+		}
+
+		c.files[name] = file
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var warc = NewWarcWriter(file, true)
+
+	if info.Size() == 0 {
+		if err := warc.WriteInfo(filepath.Base(path)); err != nil {
+			return nil, err
+		}
+
+		if info, err = file.Stat(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := warc.WriteArticle(a, page); err != nil {
+		return nil, err
+	}
+
+	end, err := file.Stat()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ColdPage{name, info.Size(), end.Size() - info.Size()}, nil
+}
+
+// Sync writes the archives to disk, the articles may refer to them after.
+func (c *coldArchive) Sync() error {
+	for _, file := range c.files {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *coldArchive) Close() error {
+	for name, file := range c.files {
+		if err := file.Close(); err != nil {
+			return err
+		}
+
+		delete(c.files, name)
+	}
+
+	return nil
+}
+
+// coldDate returns the date the retention of a counts from.
+func coldDate(a *Article) time.Time {
+	if a.FirstSeen.IsZero() {
+		return a.PubDate
+	}
+
+	return a.FirstSeen
+}
+
+// retain moves the pages of sources older than their retention to the
+// cold archive, all sources with a retention if none are given.
+func retain(args []string) {
+	var flags = flag.NewFlagSet("retain", flag.ExitOnError)
+	var restart = flags.Bool("restart", false, "start again with the first article instead of the checkpoint")
+
+	flags.Parse(args)
+
+	var names = flags.Args()
+
+	if len(names) == 0 {
+		for name, s := range config.Sources {
+			if s.Retention != nil {
+				names = append(names, name)
+			}
+		}
+
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		var r = config.Source(name).Retention
+
+		if r == nil {
+			log.Println(name, "has no retention, skipping")
+			continue
+		}
+
+		var before = time.Now().AddDate(0, 0, -r.HotDays)
+		var moved, size, err = Retain(name, before, *restart)
+
+		if err != nil {
+			log.Fatal(name, ": ", err)
+		}
+
+		log.Printf("%s: moved %d pages of %d bytes seen before %s to %s",
+			name, moved, size, before.Format("2006-01-02"), *coldDir)
+	}
+}
+
+// Retain moves the pages of the articles of a source first seen before a
+// date to the cold archive and keeps their text in Text. It returns the
+// number of pages moved and the size they had in the database.
+func Retain(name string, before time.Time, restart bool) (moved int, size int64, err error) {
+	store, err := OpenStore(name)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	batches, err := NewBatchIterator(store, "retain", AllArticles, batchSize)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if restart {
+		if err := batches.Restart(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var archive = newColdArchive(name)
+	defer archive.Close()
+
+	for {
+		var batch, err = batches.Next()
+
+		if err != nil {
+			return moved, size, err
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var changed []*Article
+		var sizes = make(map[string]int)
+
+		for _, a := range batch {
+			if a.Cold != nil || !coldDate(a).Before(before) {
+				continue
+			}
+
+			var page, err = articlePage(a)
+
+			if err != nil {
+				log.Printf("Error reading page of %x %v", a.Id, err)
+				continue
+			}
+
+			if page == nil {
+				continue
+			}
+
+			text, err := PageText(bytes.NewReader(page))
+
+			if err != nil {
+				log.Printf("Error reading text of %x %v", a.Id, err)
+				continue
+			}
+
+			cold, err := archive.Put(a, page)
+
+			if err != nil {
+				return moved, size, err
+			}
+
+			sizes[a.Id] = len(a.WebsiteRaw)
+
+			if a.SiteData != nil {
+				sizes[a.Id] += len(a.SiteData.Data)
+			}
+
+			a.Text = text
+			a.Cold = cold
+			a.WebsiteRaw, a.WebsiteHash, a.SiteData = nil, "", nil
+			changed = append(changed, a)
+		}
+
+		var result *BatchResult
+
+		if len(changed) > 0 {
+			if err := archive.Sync(); err != nil {
+				return moved, size, err
+			}
+
+			if result, err = store.UpdateColdBatch(changed); err != nil {
+				return moved, size, err
+			}
+
+			logFailed(result)
+
+			for _, a := range changed {
+				if _, failed := result.Failed[a.Id]; failed {
+					continue
+				}
+
+				moved++
+				size += int64(sizes[a.Id])
+			}
+		}
+
+		if err := batches.Commit(result); err != nil {
+			return moved, size, err
+		}
+	}
+
+	return moved, size, batches.Restart()
+}
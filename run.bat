@@ -1 +1 @@
-go run index.go feed.go database.go secrets.go article.go
+go run index.go feed.go item.go lenient.go database.go store.go filestore.go article.go sink.go crawl.go links.go config.go archive.go websub.go backfill.go scope.go batch.go schema.go migrate.go query.go warc.go export.go codec.go minify.go blob.go retention.go stats.go verify.go
\ No newline at end of file
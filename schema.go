@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"launchpad.net/mgo"
+	"launchpad.net/mgo/bson"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The indexes of the articles collection, the first one is unique.
+var articleIndexes = []mgo.Index{
+	{Key: []string{"id"}, Unique: true},
+	{Key: []string{"-pubDate"}},
+	{Key: []string{"section", "-pubDate"}},
+	{Key: []string{"-firstSeen"}},
+	{Key: []string{"source", "-pubDate"}},
+	{Key: []string{"source", "_id"}},
+}
+
+// How often the progress of index builds is logged.
+const indexProgressInterval = 10 * time.Second
+
+// The number of duplicates listed when the unique index cannot be built.
+const maxDuplicatesListed = 20
+
+// EnsureSchema creates the indexes of the database of a source. Building
+// an index on a large collection takes a while, its progress is logged.
+// It fails listing the duplicates if there are articles with the same id.
+func EnsureSchema(name string) error {
+	var session, db, err = copyDb(name)
+
+	if err != nil {
+		return err
+	}
+
+	defer session.Close()
+
+	var articles = db.C("articles")
+
+	for i, index := range articleIndexes {
+		var err = ensureIndex(session, articles, index)
+
+		if err != nil && i == 0 {
+			if duplicates := duplicateIds(articles); duplicates != "" {
+				return fmt.Errorf("%s: cannot create unique index on id: %v\n%s", name, err, duplicates)
+			}
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: index %v: %v", name, index.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// ensureIndex creates index, logging the progress of the build until it
+// is done.
+func ensureIndex(session *mgo.Session, c *mgo.Collection, index mgo.Index) error {
+	var done = make(chan error, 1)
+
+	go func() {
+		done <- c.EnsureIndex(index)
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(indexProgressInterval):
+			for _, msg := range indexProgress(session, c.FullName) {
+				log.Println("Building index", index.Key, "on", c.FullName, msg)
+			}
+		}
+	}
+}
+
+// indexProgress returns the messages of index builds running on the
+// collection ns.
+func indexProgress(session *mgo.Session, ns string) []string {
+	var reply struct {
+		Inprog []struct {
+			Ns  string "ns"
+			Msg string "msg"
+		} "inprog"
+	}
+
+	if err := session.DB("admin").Run(bson.D{{"currentOp", 1}}, &reply); err != nil {
+		log.Println("Error reading index progress", err)
+		return nil
+	}
+
+	var messages []string
+
+	for _, op := range reply.Inprog {
+		if op.Ns == ns && strings.Contains(op.Msg, "Index") {
+			messages = append(messages, op.Msg)
+		}
+	}
+
+	return messages
+}
+
+// duplicateIds lists the ids stored more than once with their links, or
+// returns "" if there are none.
+func duplicateIds(c *mgo.Collection) string {
+	var duplicates []struct {
+		Id    string   "_id"
+		Count int      "count"
+		Links []string "links"
+	}
+
+	var pipeline = []bson.M{
+		{"$group": bson.M{"_id": "$id", "count": bson.M{"$sum": 1}, "links": bson.M{"$addToSet": "$link"}}},
+		{"$match": bson.M{"count": bson.M{"$gt": 1}}},
+	}
+
+	if err := c.Pipe(pipeline).All(&duplicates); err != nil {
+		log.Println("Error looking for duplicates", err)
+		return ""
+	}
+
+	if len(duplicates) == 0 {
+		return ""
+	}
+
+	var lines = []string{fmt.Sprintf("%d ids are stored more than once:", len(duplicates))}
+
+	for i, d := range duplicates {
+		if i == maxDuplicatesListed {
+			lines = append(lines, "...")
+			break
+		}
+
+		lines = append(lines, fmt.Sprintf("  %x %d times: %s", d.Id, d.Count, strings.Join(d.Links, " ")))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// schema creates the indexes of the given or else all configured sources.
+// This happens anyway when a store is opened, but building indexes on
+// large collections is better done up front.
+func schema(args []string) {
+	var flags = flag.NewFlagSet("schema", flag.ExitOnError)
+
+	flags.Parse(args)
+
+	var names = flags.Args()
+
+	if len(names) == 0 {
+		for name := range config.Sources {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		if err := EnsureSchema(name); err != nil {
+			log.Fatal(err)
+		}
+
+		log.Println(name, "ok")
+	}
+}
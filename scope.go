@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Kind tells what a URL of a source points to.
+type Kind string
+
+const (
+	KindArticle  Kind = "article"
+	KindGallery  Kind = "gallery"
+	KindVideo    Kind = "video"
+	KindTicker   Kind = "ticker"
+	KindOffsite  Kind = "offsite"
+	KindExcluded Kind = "excluded"
+)
+
+var kinds = map[Kind]bool{
+	KindArticle:  true,
+	KindGallery:  true,
+	KindVideo:    true,
+	KindTicker:   true,
+	KindOffsite:  true,
+	KindExcluded: true,
+}
+
+// ScopeConfig decides what the URLs of a source are. URLs on other hosts
+// than Hosts are off-site, the others get the kind of the first rule they
+// match or Default.
+type ScopeConfig struct {
+	Hosts   []string     `json:"hosts"`
+	Rules   []*ScopeRule `json:"rules"`
+	Default Kind         `json:"default"`
+}
+
+// ScopeRule matches URLs by host, path and query. Empty conditions match
+// every URL.
+type ScopeRule struct {
+	Kind Kind `json:"kind"`
+	// Host is a glob, "blick.ch" also matches its subdomains.
+	Host string `json:"host"`
+	// Path is a glob, see path.Match.
+	Path  string `json:"path"`
+	Regex string `json:"regex"`
+	// Query lists parameters that must be present, with a glob for their
+	// value. An empty glob matches every value.
+	Query map[string]string `json:"query"`
+
+	regex *regexp.Regexp
+}
+
+// defaultScopes only single out galleries, videos and tickers, everything
+// else on the site of a source is taken to be an article.
+var defaultScopes = map[string]*ScopeConfig{
+	"tagi": {
+		Hosts: []string{"tagesanzeiger.ch"},
+		Rules: []*ScopeRule{
+			{Kind: KindGallery, Regex: `/(bildstrecke|diashow)/`},
+			{Kind: KindVideo, Regex: `/videos?/`},
+			{Kind: KindTicker, Regex: `ticker`},
+		},
+	},
+	"blick": {
+		Hosts: []string{"blick.ch"},
+		Rules: []*ScopeRule{
+			{Kind: KindGallery, Regex: `/(bildstrecke|diashow|galerie)/`},
+			{Kind: KindVideo, Regex: `/videos?/`},
+			{Kind: KindTicker, Regex: `ticker`},
+		},
+	},
+	"min20": {
+		Hosts: []string{"20min.ch"},
+		Rules: []*ScopeRule{
+			{Kind: KindGallery, Regex: `/diashow/`},
+			{Kind: KindVideo, Regex: `/videotv/|/video/`},
+			{Kind: KindTicker, Regex: `ticker`},
+		},
+	},
+}
+
+type Scope struct {
+	config *ScopeConfig
+}
+
+func NewScope(c *ScopeConfig) (*Scope, error) {
+	if c.Default == "" {
+		c.Default = KindArticle
+	}
+
+	if !kinds[c.Default] {
+		return nil, errors.New("Unknown kind " + string(c.Default))
+	}
+
+	for _, rule := range c.Rules {
+		if !kinds[rule.Kind] {
+			return nil, errors.New("Unknown kind " + string(rule.Kind))
+		}
+
+		if _, err := path.Match(rule.Path, ""); err != nil {
+			return nil, err
+		}
+
+		if rule.Regex == "" {
+			continue
+		}
+
+		var rex, err = regexp.Compile(rule.Regex)
+
+		if err != nil {
+			return nil, err
+		}
+
+		rule.regex = rex
+	}
+
+	return &Scope{c}, nil
+}
+
+// SourceScope returns the configured scope of a source, or its default.
+func SourceScope(name string) (*Scope, error) {
+	var c = config.Source(name).Scope
+
+	if c == nil {
+		c = defaultScopes[name]
+	}
+
+	if c == nil {
+		return nil, errors.New("No scope for source " + name)
+	}
+
+	return NewScope(c)
+}
+
+// Classify returns the kind of link and the rule that decided it, which is
+// nil if no rule matched.
+func (s *Scope) Classify(link string) (Kind, *ScopeRule) {
+	var u, err = url.Parse(link)
+
+	if err != nil || u.Host == "" {
+		return KindExcluded, nil
+	}
+
+	var host = strings.ToLower(u.Host)
+	var onsite = len(s.config.Hosts) == 0
+
+	for _, h := range s.config.Hosts {
+		if hostMatch(h, host) {
+			onsite = true
+			break
+		}
+	}
+
+	if !onsite {
+		return KindOffsite, nil
+	}
+
+	for _, rule := range s.config.Rules {
+		if rule.match(host, u) {
+			return rule.Kind, rule
+		}
+	}
+
+	return s.config.Default, nil
+}
+
+// Is reports whether link is of the given kind.
+func (s *Scope) Is(link string, kind Kind) bool {
+	var k, _ = s.Classify(link)
+
+	return k == kind
+}
+
+func (r *ScopeRule) match(host string, u *url.URL) bool {
+	if r.Host != "" && !hostMatch(r.Host, host) {
+		return false
+	}
+
+	if r.Path != "" {
+		if ok, _ := path.Match(r.Path, u.Path); !ok {
+			return false
+		}
+	}
+
+	if r.regex != nil && !r.regex.MatchString(u.Path) {
+		return false
+	}
+
+	var query = u.Query()
+
+	for key, glob := range r.Query {
+		var values, ok = query[key]
+
+		if !ok {
+			return false
+		}
+
+		if glob == "" {
+			continue
+		}
+
+		var matched = false
+
+		for _, v := range values {
+			if ok, _ := path.Match(glob, v); ok {
+				matched = true
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *ScopeRule) String() string {
+	var conditions []string
+
+	if r.Host != "" {
+		conditions = append(conditions, "host "+r.Host)
+	}
+
+	if r.Path != "" {
+		conditions = append(conditions, "path "+r.Path)
+	}
+
+	if r.Regex != "" {
+		conditions = append(conditions, "regex "+r.Regex)
+	}
+
+	for key, glob := range r.Query {
+		conditions = append(conditions, "query "+key+"="+glob)
+	}
+
+	return string(r.Kind) + " if " + strings.Join(conditions, ", ")
+}
+
+func hostMatch(pattern, host string) bool {
+	if ok, _ := path.Match(pattern, host); ok {
+		return true
+	}
+
+	return strings.HasSuffix(host, "."+pattern)
+}
+
+func scope(args []string) {
+	var flags = flag.NewFlagSet("scope", flag.ExitOnError)
+
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		log.Fatal("usage: scope source url...")
+	}
+
+	var s, err = SourceScope(flags.Arg(0))
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, link := range flags.Args()[1:] {
+		var kind, rule = s.Classify(link)
+
+		if rule != nil {
+			fmt.Printf("%s\t%s\t(%s)\n", kind, link, rule)
+		} else {
+			fmt.Printf("%s\t%s\n", kind, link)
+		}
+	}
+}
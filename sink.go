@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// An ArticleSink receives the articles produced by a Fetch. Put may be
+// called from several goroutines at once.
+type ArticleSink interface {
+	Put(a *Article) error
+	Close() error
+}
+
+// MemorySink keeps every article it receives. It is mostly useful in tests.
+type MemorySink struct {
+	Articles []*Article
+
+	mutex sync.Mutex
+}
+
+func NewMemorySink() *MemorySink {
+	return new(MemorySink)
+}
+
+func (s *MemorySink) Put(a *Article) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.Articles = append(s.Articles, a)
+
+	return nil
+}
+
+func (s *MemorySink) Close() error {
+	return nil
+}
+
+// DatabaseSink upserts articles into a store in batches. A batch is
+// written as soon as it holds size articles or when interval has passed
+// since the last write, whatever comes first. Articles that could not be
+// written are kept for the next batch.
+type DatabaseSink struct {
+	store ArticleStore
+	size  int
+
+	mutex   sync.Mutex
+	batch   []*Article
+	retries map[string]int
+	ticker  *time.Ticker
+	done    chan bool
+}
+
+// An article that could not be written is tried again with the next
+// batches this many times.
+const maxRetries = 3
+
+func NewDatabaseSink(store ArticleStore, size int, interval time.Duration) *DatabaseSink {
+	var sink = new(DatabaseSink)
+
+	sink.store = store
+	sink.size = size
+	sink.retries = make(map[string]int)
+	sink.ticker = time.NewTicker(interval)
+	sink.done = make(chan bool)
+
+	go func() {
+		for {
+			select {
+			case <-sink.ticker.C:
+				if err := sink.Flush(); err != nil {
+					log.Println("Error flushing", err)
+				}
+			case <-sink.done:
+				return
+			}
+		}
+	}()
+
+	return sink
+}
+
+// openDatabaseSink returns a DatabaseSink writing to the store of a source.
+func openDatabaseSink(name string, size int, interval time.Duration) (*DatabaseSink, error) {
+	var store, err = OpenStore(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDatabaseSink(store, size, interval), nil
+}
+
+func (s *DatabaseSink) Put(a *Article) error {
+	s.mutex.Lock()
+	s.batch = append(s.batch, a)
+	var full = len(s.batch) >= s.size
+	s.mutex.Unlock()
+
+	if full {
+		return s.Flush()
+	}
+
+	return nil
+}
+
+func (s *DatabaseSink) Flush() error {
+	s.mutex.Lock()
+	var batch = s.batch
+	s.batch = nil
+	s.mutex.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	var result, err = s.store.UpsertBatch(batch)
+
+	if err != nil {
+		s.retry(batch)
+		return err
+	}
+
+	logFailed(result)
+
+	var failed []*Article
+
+	s.mutex.Lock()
+
+	for _, a := range batch {
+		if _, ok := result.Failed[a.Id]; ok {
+			failed = append(failed, a)
+		} else {
+			delete(s.retries, a.Id)
+		}
+	}
+
+	s.mutex.Unlock()
+
+	s.retry(failed)
+
+	return result.Err()
+}
+
+// retry puts articles back in front of the batch for the next Flush. An
+// article that failed maxRetries times is dropped.
+func (s *DatabaseSink) retry(articles []*Article) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var kept []*Article
+
+	for _, a := range articles {
+		s.retries[a.Id]++
+
+		if s.retries[a.Id] > maxRetries {
+			log.Printf("Dropping %x after %d failed writes", a.Id, maxRetries)
+			delete(s.retries, a.Id)
+			continue
+		}
+
+		kept = append(kept, a)
+	}
+
+	s.batch = append(kept, s.batch...)
+}
+
+func (s *DatabaseSink) Close() error {
+	s.ticker.Stop()
+	s.done <- true
+
+	return s.Flush()
+}
+
+// JsonSink writes one JSON object per line for every article it receives.
+type JsonSink struct {
+	mutex   sync.Mutex
+	writer  io.WriteCloser
+	encoder *json.Encoder
+}
+
+func NewJsonSink(writer io.WriteCloser) *JsonSink {
+	var sink = new(JsonSink)
+
+	sink.writer = writer
+	sink.encoder = json.NewEncoder(writer)
+
+	return sink
+}
+
+// OpenJsonSink appends to the file at path, creating it if necessary.
+func OpenJsonSink(path string) (*JsonSink, error) {
+	var file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewJsonSink(file), nil
+}
+
+func (s *JsonSink) Put(a *Article) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.encoder.Encode(toJsonArticle(a))
+}
+
+func (s *JsonSink) Close() error {
+	return s.writer.Close()
+}
+
+// jsonArticle is the JSON representation of an Article. The id is hex
+// encoded because the raw md5 sum is not valid UTF-8. Text is only set by
+// export.
+type jsonArticle struct {
+	Id         string     `json:"id"`
+	Title      string     `json:"title"`
+	Summary    string     `json:"summary"`
+	PubDate    time.Time  `json:"pubDate"`
+	Link       string     `json:"link"`
+	Kind       Kind       `json:"kind,omitempty"`
+	Source     string     `json:"source,omitempty"`
+	Section    string     `json:"section,omitempty"`
+	Media      []Media    `json:"media,omitempty"`
+	Categories []string   `json:"categories,omitempty"`
+	Authors    []string   `json:"authors,omitempty"`
+	FirstSeen  *time.Time `json:"firstSeen,omitempty"`
+	Text       string     `json:"text,omitempty"`
+}
+
+func toJsonArticle(a *Article) *jsonArticle {
+	var j = &jsonArticle{
+		Id:         hex.EncodeToString([]byte(a.Id)),
+		Title:      a.Title,
+		Summary:    a.Summary,
+		PubDate:    a.PubDate,
+		Link:       a.Link,
+		Kind:       a.Kind,
+		Source:     a.Source,
+		Section:    a.Section,
+		Media:      a.Media,
+		Categories: a.Categories,
+		Authors:    a.Authors,
+	}
+
+	if !a.FirstSeen.IsZero() {
+		var firstSeen = a.FirstSeen
+		j.FirstSeen = &firstSeen
+	}
+
+	return j
+}
+
+// fromJsonArticle converts j back to an Article. Without an id, it is
+// computed from the link like NewArticle does.
+func fromJsonArticle(j *jsonArticle) (*Article, error) {
+	var id, err = hex.DecodeString(j.Id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(id) == 0 {
+		var h = md5.New()
+		io.WriteString(h, j.Link)
+		id = h.Sum(nil)
+	}
+
+	var a = &Article{
+		Id:         string(id),
+		Title:      j.Title,
+		Summary:    j.Summary,
+		PubDate:    j.PubDate,
+		Link:       j.Link,
+		Kind:       j.Kind,
+		Source:     j.Source,
+		Section:    j.Section,
+		Media:      j.Media,
+		Categories: j.Categories,
+		Authors:    j.Authors,
+	}
+
+	if j.FirstSeen != nil {
+		a.FirstSeen = *j.FirstSeen
+	}
+
+	return a, nil
+}
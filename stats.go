@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+)
+
+// FieldStats sums the sizes of one field of the articles of a source.
+// Compressed is the size stored, Decompressed that of the pages read back.
+type FieldStats struct {
+	Count        int     `json:"count"`
+	Compressed   int64   `json:"compressed"`
+	Decompressed int64   `json:"decompressed"`
+	Ratio        float64 `json:"ratio"`
+}
+
+func (f *FieldStats) add(compressed, decompressed int64) {
+	f.Count++
+	f.Compressed += compressed
+	f.Decompressed += decompressed
+}
+
+func (f *FieldStats) setRatio() {
+	if f.Compressed > 0 {
+		f.Ratio = float64(f.Decompressed) / float64(f.Compressed)
+	}
+}
+
+// DocumentSize is the stored size of the page and text of an article, also
+// if its page is in a blob or the cold archive. The rest of the document is
+// small.
+type DocumentSize struct {
+	Id   string `json:"id"`
+	Link string `json:"link"`
+	Size int64  `json:"size"`
+}
+
+// SourceStats reports the storage used by a source. The fields are
+// websiteRaw, site, blob, cold and text. Blobs are counted once for every
+// article, their size once for every blob.
+type SourceStats struct {
+	Source    string                 `json:"source"`
+	Documents int                    `json:"documents"`
+	Legacy    int                    `json:"legacy"`
+	Errors    int                    `json:"errors"`
+	Fields    map[string]*FieldStats `json:"fields"`
+	Total     *FieldStats            `json:"total"`
+	Largest   []DocumentSize         `json:"largest"`
+}
+
+var statsFields = []string{"websiteRaw", "site", "blob", "cold", "text"}
+
+// readSize returns the number of bytes in reader and closes it.
+func readSize(reader io.ReadCloser, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+
+	defer reader.Close()
+
+	return io.Copy(ioutil.Discard, reader)
+}
+
+// SourceStatistics scans the articles of a source and reports the top
+// largest ones.
+func SourceStatistics(name string, top int) (*SourceStats, error) {
+	var store, err = OpenStore(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var stats = &SourceStats{Source: name, Fields: make(map[string]*FieldStats), Total: new(FieldStats)}
+
+	for _, field := range statsFields {
+		stats.Fields[field] = new(FieldStats)
+	}
+
+	var blobSizes = make(map[string]int64)
+	var iter = store.Articles()
+
+	for a := new(Article); iter.Next(a); a = new(Article) {
+		stats.Documents++
+
+		var size, err = stats.addArticle(a, blobSizes)
+
+		if err != nil {
+			log.Printf("Error reading %x %v", a.Id, err)
+			stats.Errors++
+		}
+
+		stats.addLargest(DocumentSize{hex.EncodeToString([]byte(a.Id)), a.Link, size}, top)
+	}
+
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+
+	stats.Total.Count = stats.Documents
+
+	for _, field := range statsFields {
+		var f = stats.Fields[field]
+		stats.Total.Compressed += f.Compressed
+		stats.Total.Decompressed += f.Decompressed
+		f.setRatio()
+	}
+
+	stats.Total.setRatio()
+
+	return stats, nil
+}
+
+// addArticle adds the fields of a and returns their stored size, including
+// its blob and cold page. blobSizes holds the sizes of the blobs added.
+func (s *SourceStats) addArticle(a *Article, blobSizes map[string]int64) (int64, error) {
+	var size = int64(len(a.Text))
+	var failed error
+
+	if a.WebsiteRaw != nil {
+		var n, err = readSize(Decompress(a.WebsiteRaw))
+
+		if err != nil {
+			failed = err
+		}
+
+		s.Fields["websiteRaw"].add(int64(len(a.WebsiteRaw)), n)
+		size += int64(len(a.WebsiteRaw))
+	}
+
+	if a.SiteData != nil {
+		var n, err = readSize(a.Site())
+
+		if err != nil && err != ErrNoData {
+			failed = err
+		}
+
+		s.Legacy++
+		s.Fields["site"].add(int64(len(a.SiteData.Data)), n)
+		size += int64(len(a.SiteData.Data))
+	}
+
+	if a.WebsiteHash != "" {
+		var blob = s.Fields["blob"]
+
+		if n, ok := blobSizes[a.WebsiteHash]; ok {
+			blob.Count++
+			size += n
+		} else {
+			var data, err = LoadBlob(a.WebsiteHash)
+			var n int64
+
+			if err == nil {
+				// A blob that could not be loaded is tried again by the
+				// next article referencing it.
+				blobSizes[a.WebsiteHash] = int64(len(data))
+				n, err = readSize(Decompress(data))
+			}
+
+			if err != nil {
+				failed = err
+			}
+
+			blob.add(int64(len(data)), n)
+			size += int64(len(data))
+		}
+	}
+
+	if a.Cold != nil {
+		var n, err = readSize(LoadColdPage(a.Cold))
+
+		if err != nil {
+			failed = err
+		}
+
+		s.Fields["cold"].add(a.Cold.Length, n)
+		size += a.Cold.Length
+	}
+
+	if a.Text != "" {
+		s.Fields["text"].add(int64(len(a.Text)), int64(len(a.Text)))
+	}
+
+	return size, failed
+}
+
+// addLargest keeps the top largest documents, largest first.
+func (s *SourceStats) addLargest(d DocumentSize, top int) {
+	if top <= 0 || len(s.Largest) == top && d.Size <= s.Largest[top-1].Size {
+		return
+	}
+
+	s.Largest = append(s.Largest, d)
+	sort.Sort(bySize(s.Largest))
+
+	if len(s.Largest) > top {
+		s.Largest = s.Largest[:top]
+	}
+}
+
+type bySize []DocumentSize
+
+func (s bySize) Len() int {
+	return len(s)
+}
+
+func (s bySize) Less(i, j int) bool {
+	return s[i].Size > s[j].Size
+}
+
+func (s bySize) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// stats reports the storage used by the given or else all sources.
+func stats(args []string) {
+	var flags = flag.NewFlagSet("stats", flag.ExitOnError)
+	var asJson = flags.Bool("json", false, "print a JSON array instead of a table")
+	var top = flags.Int("top", 10, "number of largest documents to list")
+
+	flags.Parse(args)
+
+	var names = flags.Args()
+
+	if len(names) == 0 {
+		for name := range sourceFeeds {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+	}
+
+	var all []*SourceStats
+
+	for _, name := range names {
+		var s, err = SourceStatistics(name, *top)
+
+		if err != nil {
+			log.Fatal(name, ": ", err)
+		}
+
+		all = append(all, s)
+	}
+
+	if *asJson {
+		if err := json.NewEncoder(os.Stdout).Encode(all); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	for _, s := range all {
+		fmt.Printf("%s: %d documents, %d legacy, %d errors\n", s.Source, s.Documents, s.Legacy, s.Errors)
+		fmt.Printf("  %-10s %8s %14s %14s %6s\n", "field", "count", "compressed", "decompressed", "ratio")
+
+		for _, field := range statsFields {
+			var f = s.Fields[field]
+			fmt.Printf("  %-10s %8d %14d %14d %6.2f\n", field, f.Count, f.Compressed, f.Decompressed, f.Ratio)
+		}
+
+		fmt.Printf("  %-10s %8d %14d %14d %6.2f\n", "total", s.Total.Count, s.Total.Compressed, s.Total.Decompressed, s.Total.Ratio)
+
+		for _, d := range s.Largest {
+			fmt.Printf("  %10d %s %s\n", d.Size, d.Id, d.Link)
+		}
+	}
+}
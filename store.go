@@ -0,0 +1,816 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrNotFound = errors.New("Article not found")
+
+// ArticleStore holds the articles of one source.
+type ArticleStore interface {
+	ReadBatch(skip, take int) ([]*Article, error)
+	// ReadOldBatch reads articles that still have SiteData.
+	ReadOldBatch(skip, take int) ([]*Article, error)
+	// UpdateBatch replaces stored articles and inserts the new ones. New
+	// articles without FirstSeen are inserted with the current time and
+	// schema. It adds a reference to the blob of a WebsiteHash the stored
+	// article did not have, as the articles are copies of ones stored
+	// elsewhere. Like UpdateWebsiteBatch and Update, it releases the blob
+	// of a page it replaces.
+	UpdateBatch(batch []*Article) (*BatchResult, error)
+	// UpdateWebsiteBatch stores WebsiteRaw, WebsiteHash and SiteData,
+	// removing SiteData if it is nil. Articles not stored fail with
+	// ErrNotFound. The caller owns the reference to a new blob.
+	UpdateWebsiteBatch(batch []*Article) (*BatchResult, error)
+	// UpdateColdBatch stores Text and Cold of articles whose page moved to
+	// the cold archive and removes WebsiteRaw, WebsiteHash and SiteData.
+	// Articles not stored fail with ErrNotFound.
+	UpdateColdBatch(batch []*Article) (*BatchResult, error)
+	// UpsertBatch inserts new articles and updates the feed fields of known
+	// ones, leaving stored websites untouched. New articles are stored
+	// without a page.
+	UpsertBatch(batch []*Article) (*BatchResult, error)
+	// NewIds returns the ids not stored yet, in the order given.
+	NewIds(ids []string) ([]string, error)
+	// Ids returns the ids of all stored articles.
+	Ids() ([]string, error)
+	// Find returns the articles selected by q.
+	Find(q *Query) ArticleIter
+	Articles() ArticleIter
+	// Update replaces a stored article, it returns ErrNotFound if there is
+	// none with the same id.
+	Update(a *Article) error
+	// ReadBatchAfter reads up to take articles ordered by their storage
+	// key, starting after the key cursor, "" starts at the beginning. It
+	// returns the key of the last article read.
+	ReadBatchAfter(filter BatchFilter, cursor string, take int) ([]*Article, string, error)
+	// Checkpoint returns the cursor saved under name, "" if there is none.
+	Checkpoint(name string) (string, error)
+	SetCheckpoint(name, cursor string) error
+}
+
+type ArticleIter interface {
+	Next(a *Article) bool
+	Err() error
+	Close() error
+}
+
+// errorIter is an empty ArticleIter that reports err.
+type errorIter struct {
+	err error
+}
+
+func (it *errorIter) Next(a *Article) bool {
+	return false
+}
+
+func (it *errorIter) Err() error {
+	return it.err
+}
+
+func (it *errorIter) Close() error {
+	return nil
+}
+
+var storeDir = flag.String("store", "", "keep articles in files in this directory instead of mongo")
+
+// The file stores and archives opened so far, by source. Two of them must
+// not write to the same files.
+var (
+	filesMutex   sync.Mutex
+	fileStores   = make(map[string]*FileStore)
+	fileArchives = make(map[string]*FileArchive)
+)
+
+// The mongo stores opened so far, by source, the store of all sources in the
+// -unified database and the databases whose schema was ensured. Stores of a
+// source share the cache of known ids.
+var (
+	mongoMutex   sync.Mutex
+	mongoStores  = make(map[string]*CachedStore)
+	sharedStore  *MongoStore
+	mongoSchemas = make(map[string]bool)
+)
+
+// OpenStore returns the store of a source.
+func OpenStore(name string) (ArticleStore, error) {
+	if *storeDir == "" {
+		var database, source = mongoLocation(name)
+
+		if _, err := connect(database); err != nil {
+			return nil, err
+		}
+
+		mongoMutex.Lock()
+		defer mongoMutex.Unlock()
+
+		if s, ok := mongoStores[name]; ok {
+			return s, nil
+		}
+
+		if err := ensureSchemaOnce(database); err != nil {
+			return nil, err
+		}
+
+		var s = NewCachedStore(NewSourceStore(database, source))
+		mongoStores[name] = s
+
+		return s, nil
+	}
+
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	if s, ok := fileStores[name]; ok {
+		return s, nil
+	}
+
+	var s, err = OpenFileStore(filepath.Join(*storeDir, name))
+
+	if err != nil {
+		return nil, err
+	}
+
+	fileStores[name] = s
+
+	return s, nil
+}
+
+// ensureSchemaOnce ensures the schema of a database the first time one of
+// its stores is opened. The caller holds mongoMutex.
+func ensureSchemaOnce(database string) error {
+	if mongoSchemas[database] {
+		return nil
+	}
+
+	if err := EnsureSchema(database); err != nil {
+		return err
+	}
+
+	mongoSchemas[database] = true
+
+	return nil
+}
+
+// mongoLocation returns the database holding the articles of a source and
+// the source to select in it, which is "" if the database is not shared.
+func mongoLocation(name string) (database, source string) {
+	if config.Unified == "" {
+		return name, ""
+	}
+
+	return config.Unified, name
+}
+
+// OpenSharedStore returns the store of all sources in the -unified
+// database.
+func OpenSharedStore() (ArticleStore, error) {
+	if config.Unified == "" || *storeDir != "" {
+		return nil, errors.New("No unified database, set one with -unified")
+	}
+
+	if _, err := connect(config.Unified); err != nil {
+		return nil, err
+	}
+
+	mongoMutex.Lock()
+	defer mongoMutex.Unlock()
+
+	if sharedStore != nil {
+		return sharedStore, nil
+	}
+
+	if err := ensureSchemaOnce(config.Unified); err != nil {
+		return nil, err
+	}
+
+	sharedStore = NewMongoStore(config.Unified)
+
+	return sharedStore, nil
+}
+
+// OpenArchive returns the feed archive of a source.
+func OpenArchive(name string) (FeedArchive, error) {
+	if *storeDir == "" {
+		var database, source = mongoLocation(name)
+
+		if _, err := connect(database); err != nil {
+			return nil, err
+		}
+
+		return NewDatabaseArchive(database, source), nil
+	}
+
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	if a, ok := fileArchives[name]; ok {
+		return a, nil
+	}
+
+	var a, err = OpenFileArchive(filepath.Join(*storeDir, name))
+
+	if err != nil {
+		return nil, err
+	}
+
+	fileArchives[name] = a
+
+	return a, nil
+}
+
+// CloseStores closes the file stores, archives and blobs.
+func CloseStores() error {
+	filesMutex.Lock()
+	defer filesMutex.Unlock()
+
+	for name, s := range fileStores {
+		if err := s.Close(); err != nil {
+			return err
+		}
+
+		delete(fileStores, name)
+	}
+
+	for name, a := range fileArchives {
+		if err := a.Close(); err != nil {
+			return err
+		}
+
+		delete(fileArchives, name)
+	}
+
+	return closeBlobs()
+}
+
+// MemoryStore keeps articles in memory, in insertion order.
+type MemoryStore struct {
+	mutex       sync.RWMutex
+	ids         []string
+	articles    map[string]*Article
+	checkpoints map[string]string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		articles:    make(map[string]*Article),
+		checkpoints: make(map[string]string),
+	}
+}
+
+func (s *MemoryStore) ReadBatch(skip, take int) ([]*Article, error) {
+	return s.read(skip, take, func(a *Article) bool { return true }), nil
+}
+
+func (s *MemoryStore) ReadOldBatch(skip, take int) ([]*Article, error) {
+	return s.read(skip, take, func(a *Article) bool { return a.SiteData != nil }), nil
+}
+
+func (s *MemoryStore) read(skip, take int, pred func(a *Article) bool) []*Article {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var batch []*Article
+
+	for _, id := range s.ids {
+		var a = s.articles[id]
+
+		if !pred(a) {
+			continue
+		}
+
+		if skip > 0 {
+			skip--
+			continue
+		}
+
+		if len(batch) == take {
+			break
+		}
+
+		batch = append(batch, copyArticle(a))
+	}
+
+	return batch
+}
+
+func (s *MemoryStore) UpdateBatch(batch []*Article) (*BatchResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result = newBatchResult()
+	var retained, released []string
+
+	for _, a := range batch {
+		var stored, ok = s.articles[a.Id]
+
+		var updated = copyArticle(a)
+
+		if hash := addedBlob(stored, a); hash != "" {
+			retained = append(retained, hash)
+		}
+
+		if ok {
+			if hash := replacedBlob(stored, a); hash != "" {
+				released = append(released, hash)
+			}
+		}
+
+		if !ok {
+			s.ids = append(s.ids, a.Id)
+			result.Inserted++
+
+			if updated.FirstSeen.IsZero() {
+				updated.FirstSeen = time.Now()
+				updated.Schema = currentSchema()
+			}
+		} else if result.Matched++; !reflect.DeepEqual(stored, a) {
+			result.Modified++
+		}
+
+		s.articles[a.Id] = updated
+	}
+
+	if err := retainBlobs(retained); err != nil {
+		return result, err
+	}
+
+	return result, releaseBlobs(released)
+}
+
+func (s *MemoryStore) UpdateWebsiteBatch(batch []*Article) (*BatchResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result = newBatchResult()
+	var released []string
+
+	for _, a := range batch {
+		var stored, ok = s.articles[a.Id]
+
+		if !ok {
+			result.fail(a.Id, ErrNotFound)
+			continue
+		}
+
+		result.Matched++
+
+		if hash := replacedBlob(stored, a); hash != "" {
+			released = append(released, hash)
+		}
+
+		if !bytes.Equal(stored.WebsiteRaw, a.WebsiteRaw) || stored.WebsiteHash != a.WebsiteHash || !reflect.DeepEqual(stored.SiteData, a.SiteData) {
+			result.Modified++
+		}
+
+		stored.WebsiteRaw = a.WebsiteRaw
+		stored.WebsiteHash = a.WebsiteHash
+		stored.SiteData = a.SiteData
+	}
+
+	return result, releaseBlobs(released)
+}
+
+func (s *MemoryStore) UpdateColdBatch(batch []*Article) (*BatchResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result = newBatchResult()
+	var released []string
+
+	for _, a := range batch {
+		var stored, ok = s.articles[a.Id]
+
+		if !ok {
+			result.fail(a.Id, ErrNotFound)
+			continue
+		}
+
+		result.Matched++
+
+		var cold = *stored
+		cold.Text, cold.Cold = a.Text, a.Cold
+		cold.WebsiteRaw, cold.WebsiteHash, cold.SiteData = nil, "", nil
+
+		if !reflect.DeepEqual(stored, &cold) {
+			result.Modified++
+		}
+
+		if stored.WebsiteHash != "" {
+			released = append(released, stored.WebsiteHash)
+		}
+
+		s.articles[a.Id] = copyArticle(&cold)
+	}
+
+	return result, releaseBlobs(released)
+}
+
+func (s *MemoryStore) UpsertBatch(batch []*Article) (*BatchResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result = newBatchResult()
+
+	for _, a := range batch {
+		if stored, ok := s.articles[a.Id]; ok {
+			var merged = copyArticle(stored)
+			mergeFeedFields(merged, a)
+
+			result.Matched++
+
+			if !reflect.DeepEqual(stored, merged) {
+				result.Modified++
+			}
+
+			s.articles[a.Id] = merged
+			continue
+		}
+
+		var stored = new(Article)
+		mergeFeedFields(stored, a)
+		stored.FirstSeen = firstSeen(a)
+		stored.Schema = currentSchema()
+
+		s.ids = append(s.ids, a.Id)
+		s.articles[a.Id] = stored
+		result.Inserted++
+	}
+
+	return result, nil
+}
+
+func (s *MemoryStore) NewIds(ids []string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var res []string
+
+	for _, id := range ids {
+		if _, ok := s.articles[id]; !ok {
+			res = append(res, id)
+		}
+	}
+
+	return res, nil
+}
+
+func (s *MemoryStore) Ids() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var ids = make([]string, len(s.ids))
+	copy(ids, s.ids)
+
+	return ids, nil
+}
+
+func (s *MemoryStore) Find(q *Query) ArticleIter {
+	var articles = s.read(0, -1, q.Match)
+	q.sortArticles(articles)
+
+	if q.limit > 0 && len(articles) > q.limit {
+		articles = articles[:q.limit]
+	}
+
+	return &memoryIter{articles: articles}
+}
+
+func (s *MemoryStore) Articles() ArticleIter {
+	return &memoryIter{articles: s.read(0, -1, func(a *Article) bool { return true })}
+}
+
+func (s *MemoryStore) Update(a *Article) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var stored, ok = s.articles[a.Id]
+
+	if !ok {
+		return ErrNotFound
+	}
+
+	s.articles[a.Id] = copyArticle(a)
+
+	if hash := replacedBlob(stored, a); hash != "" {
+		return releaseBlob(hash)
+	}
+
+	return nil
+}
+
+// Insert adds articles as they are, mostly to fill the store in tests.
+func (s *MemoryStore) Insert(articles ...*Article) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, a := range articles {
+		if _, ok := s.articles[a.Id]; !ok {
+			s.ids = append(s.ids, a.Id)
+		}
+
+		s.articles[a.Id] = copyArticle(a)
+	}
+}
+
+// ReadBatchAfter uses the insertion position as key.
+func (s *MemoryStore) ReadBatchAfter(filter BatchFilter, cursor string, take int) ([]*Article, string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var start, err = positionCursor(cursor)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	var batch []*Article
+
+	for i := start; i < len(s.ids) && len(batch) < take; i++ {
+		var a = s.articles[s.ids[i]]
+
+		if filter == OldArticles && a.SiteData == nil {
+			continue
+		}
+
+		batch = append(batch, copyArticle(a))
+		cursor = strconv.Itoa(i)
+	}
+
+	return batch, cursor, nil
+}
+
+func (s *MemoryStore) Checkpoint(name string) (string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.checkpoints[name], nil
+}
+
+func (s *MemoryStore) SetCheckpoint(name, cursor string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.checkpoints[name] = cursor
+
+	return nil
+}
+
+// positionCursor returns the position after cursor, for stores that key
+// articles by their insertion position.
+func positionCursor(cursor string) (int, error) {
+	if cursor == "" {
+		return 0, nil
+	}
+
+	var i, err = strconv.Atoi(cursor)
+
+	if err != nil {
+		return 0, errors.New("Invalid cursor " + cursor)
+	}
+
+	return i + 1, nil
+}
+
+type memoryIter struct {
+	articles []*Article
+}
+
+func (it *memoryIter) Next(a *Article) bool {
+	if len(it.articles) == 0 {
+		return false
+	}
+
+	*a = *it.articles[0]
+	it.articles = it.articles[1:]
+
+	return true
+}
+
+func (it *memoryIter) Err() error {
+	return nil
+}
+
+func (it *memoryIter) Close() error {
+	it.articles = nil
+
+	return nil
+}
+
+// firstSeen returns the FirstSeen of an article about to be inserted, now
+// unless it was set already.
+func firstSeen(a *Article) time.Time {
+	if a.FirstSeen.IsZero() {
+		return time.Now()
+	}
+
+	return a.FirstSeen
+}
+
+// copyArticle returns a copy of a that shares no slices or structs with it.
+func copyArticle(a *Article) *Article {
+	var c = *a
+
+	if a.Media != nil {
+		c.Media = append(make([]Media, 0, len(a.Media)), a.Media...)
+	}
+
+	if a.Categories != nil {
+		c.Categories = append(make([]string, 0, len(a.Categories)), a.Categories...)
+	}
+
+	if a.Authors != nil {
+		c.Authors = append(make([]string, 0, len(a.Authors)), a.Authors...)
+	}
+
+	if a.WebsiteRaw != nil {
+		c.WebsiteRaw = append(make([]byte, 0, len(a.WebsiteRaw)), a.WebsiteRaw...)
+	}
+
+	if a.SiteData != nil {
+		var site = *a.SiteData
+
+		if a.SiteData.Data != nil {
+			site.Data = append(make([]byte, 0, len(a.SiteData.Data)), a.SiteData.Data...)
+		}
+
+		c.SiteData = &site
+	}
+
+	if a.Cold != nil {
+		var cold = *a.Cold
+		c.Cold = &cold
+	}
+
+	return &c
+}
+
+// mergeFeedFields copies the fields of src that came from a feed to dst,
+// skipping empty ones like feedFields does.
+func mergeFeedFields(dst, src *Article) {
+	dst.Id = src.Id
+	dst.Link = src.Link
+
+	if src.Title != "" {
+		dst.Title = src.Title
+	}
+
+	if src.Summary != "" {
+		dst.Summary = src.Summary
+	}
+
+	if !src.PubDate.IsZero() {
+		dst.PubDate = src.PubDate
+	}
+
+	if src.Kind != "" {
+		dst.Kind = src.Kind
+	}
+
+	if src.Source != "" {
+		dst.Source = src.Source
+	}
+
+	if src.Section != "" {
+		dst.Section = src.Section
+	}
+
+	if len(src.Media) > 0 {
+		dst.Media = src.Media
+	}
+
+	if len(src.Categories) > 0 {
+		dst.Categories = src.Categories
+	}
+
+	if len(src.Authors) > 0 {
+		dst.Authors = src.Authors
+	}
+}
+
+// CachedStore answers NewIds from a set of known ids, so checking links that
+// were seen before does not need a query. The set is loaded from the store
+// on the first call of NewIds and extended with every article written
+// through it. Ids missing from it are still checked with the store, as
+// other processes may have written them.
+type CachedStore struct {
+	ArticleStore
+
+	mutex  sync.RWMutex
+	known  map[string]bool
+	warmed bool
+}
+
+func NewCachedStore(store ArticleStore) *CachedStore {
+	return &CachedStore{ArticleStore: store, known: make(map[string]bool)}
+}
+
+// Warm loads the ids of the store unless it was done before. It holds the
+// lock while it reads them, so NewIds does not answer from a partly loaded
+// set.
+func (s *CachedStore) Warm() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.warmed {
+		return nil
+	}
+
+	var ids, err = s.ArticleStore.Ids()
+
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		s.known[id] = true
+	}
+
+	s.warmed = true
+
+	return nil
+}
+
+func (s *CachedStore) remember(ids ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, id := range ids {
+		s.known[id] = true
+	}
+}
+
+func (s *CachedStore) NewIds(ids []string) ([]string, error) {
+	if err := s.Warm(); err != nil {
+		return nil, err
+	}
+
+	var unknown []string
+
+	s.mutex.RLock()
+
+	for _, id := range ids {
+		if !s.known[id] {
+			unknown = append(unknown, id)
+		}
+	}
+
+	s.mutex.RUnlock()
+
+	if len(unknown) == 0 {
+		return nil, nil
+	}
+
+	var res, err = s.ArticleStore.NewIds(unknown)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var fresh = make(map[string]bool)
+
+	for _, id := range res {
+		fresh[id] = true
+	}
+
+	for _, id := range unknown {
+		if !fresh[id] {
+			s.remember(id)
+		}
+	}
+
+	return res, nil
+}
+
+func (s *CachedStore) UpdateBatch(batch []*Article) (*BatchResult, error) {
+	var result, err = s.ArticleStore.UpdateBatch(batch)
+	s.rememberWritten(batch, result)
+
+	return result, err
+}
+
+func (s *CachedStore) UpsertBatch(batch []*Article) (*BatchResult, error) {
+	var result, err = s.ArticleStore.UpsertBatch(batch)
+	s.rememberWritten(batch, result)
+
+	return result, err
+}
+
+func (s *CachedStore) rememberWritten(batch []*Article, result *BatchResult) {
+	if result == nil {
+		return
+	}
+
+	for _, a := range batch {
+		if _, failed := result.Failed[a.Id]; !failed {
+			s.remember(a.Id)
+		}
+	}
+}
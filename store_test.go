@@ -0,0 +1,702 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"launchpad.net/mgo/bson"
+	"os"
+	"testing"
+	"time"
+)
+
+var testMongo = flag.String("mongo", "", "also test the MongoStore in the database of this source, the articles of source storetest in it are removed")
+
+// storeTests are run against every ArticleStore, each with an empty store.
+var storeTests = []struct {
+	name string
+	test func(t *testing.T, s ArticleStore)
+}{
+	{"ReadBatch", testReadBatch},
+	{"ReadOldBatch", testReadOldBatch},
+	{"UpdateBatch", testUpdateBatch},
+	{"UpdateWebsiteBatch", testUpdateWebsiteBatch},
+	{"UpdateColdBatch", testUpdateColdBatch},
+	{"NewIds", testNewIds},
+	{"Articles", testArticles},
+	{"Update", testUpdate},
+	{"Copies", testCopies},
+	{"BlobRefs", testBlobRefs},
+}
+
+func runStoreTests(t *testing.T, open func(t *testing.T) (ArticleStore, func())) {
+	for _, test := range storeTests {
+		var s, done = open(t)
+
+		t.Logf("%s", test.name)
+		test.test(t, s)
+		done()
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T) (ArticleStore, func()) {
+		return NewMemoryStore(), func() {}
+	})
+}
+
+func TestFileStore(t *testing.T) {
+	runStoreTests(t, func(t *testing.T) (ArticleStore, func()) {
+		var dir, err = ioutil.TempDir("", "filestore")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := OpenFileStore(dir)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return s, func() {
+			s.Close()
+			os.RemoveAll(dir)
+		}
+	})
+}
+
+func TestMongoStore(t *testing.T) {
+	if *testMongo == "" {
+		t.Log("no -mongo source given, skipping")
+		return
+	}
+
+	runStoreTests(t, func(t *testing.T) (ArticleStore, func()) {
+		var clear = func() {
+			var session, db, err = copyDb(*testMongo)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer session.Close()
+
+			if _, err := db.C("articles").RemoveAll(bson.M{"source": "storetest"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		clear()
+
+		return NewSourceStore(*testMongo, "storetest"), clear
+	})
+}
+
+// TestSourceStoreUpdates checks that the writes of a store in a unified
+// database select and stamp its source.
+func TestSourceStoreUpdates(t *testing.T) {
+	var s = NewSourceStore("unified", "tagi")
+	var a = testArticle("a", "A")
+
+	s.stamp([]*Article{a})
+
+	var updates = s.updates([]*Article{a}, true, func(a *Article) interface{} {
+		return bson.M{"$set": feedFields(a)}
+	})
+
+	if q := updates[0]["q"].(bson.M); q["id"] != "a" || q["source"] != "tagi" {
+		t.Errorf("update selects %v, want id a of source tagi", q)
+	}
+
+	if set := updates[0]["u"].(bson.M)["$set"].(bson.M); set["source"] != "tagi" {
+		t.Errorf("update sets %v, want source tagi", set)
+	}
+}
+
+// TestMongoUnified writes articles through the stores of two sources in one
+// database and reads them back.
+func TestMongoUnified(t *testing.T) {
+	if *testMongo == "" {
+		t.Log("no -mongo source given, skipping")
+		return
+	}
+
+	var clear = func() {
+		var session, db, err = copyDb(*testMongo)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer session.Close()
+
+		if _, err := db.C("articles").RemoveAll(bson.M{"source": bson.M{"$in": []string{"storetest", "storetest2"}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	clear()
+	defer clear()
+
+	var s, other = NewSourceStore(*testMongo, "storetest"), NewSourceStore(*testMongo, "storetest2")
+
+	if _, err := s.UpsertBatch([]*Article{testArticle("a", "A")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := other.UpsertBatch([]*Article{testArticle("b", "B")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var page = testArticle("a", "A")
+	page.WebsiteRaw = []byte("page")
+
+	if result, err := other.UpdateWebsiteBatch([]*Article{page}); err != nil || result.Failed["a"] != ErrNotFound {
+		t.Errorf("UpdateWebsiteBatch of another source = %v %v, want a not found", result, err)
+	}
+
+	if err := s.Update(testArticle("a", "A2")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		store  *MongoStore
+		source string
+		want   string
+	}{
+		{s, "storetest", "a"},
+		{other, "storetest2", "b"},
+	} {
+		var batch, err = test.store.ReadBatch(0, 10)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !equalIds(ids(batch), test.want) {
+			t.Fatalf("source %s read %q, want %s", test.source, ids(batch), test.want)
+		}
+
+		if batch[0].Source != test.source || batch[0].WebsiteRaw != nil {
+			t.Errorf("source %s read source %q and page %q", test.source, batch[0].Source, batch[0].WebsiteRaw)
+		}
+	}
+}
+
+func TestMongoLocation(t *testing.T) {
+	var saved = config
+	defer func() { config = saved }()
+
+	var tests = []struct {
+		unified, name    string
+		database, source string
+	}{
+		{"", "tagi", "tagi", ""},
+		{"all", "tagi", "all", "tagi"},
+		{"all", "all", "all", "all"},
+	}
+
+	for _, test := range tests {
+		config = &Config{Unified: test.unified}
+
+		if database, source := mongoLocation(test.name); database != test.database || source != test.source {
+			t.Errorf("unified %q: location of %s = %s %q, want %s %q", test.unified, test.name, database, source, test.database, test.source)
+		}
+	}
+
+	config = &Config{Sources: map[string]*SourceConfig{}, Unified: "tagi"}
+
+	if err := config.Validate(); err == nil {
+		t.Error("a crawled source is accepted as unified database")
+	}
+}
+
+func testArticle(id, title string) *Article {
+	return &Article{
+		Id:      id,
+		Title:   title,
+		Link:    "http://example.com/" + id,
+		PubDate: time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func withSite(a *Article, data string) *Article {
+	a.SiteData = &struct {
+		Data       []byte
+		Compressed bool
+	}{Data: []byte(data)}
+
+	return a
+}
+
+func fill(t *testing.T, s ArticleStore, articles ...*Article) {
+	var result, err = s.UpdateBatch(articles)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result.Failed) > 0 || result.Inserted != len(articles) {
+		t.Fatalf("filling the store inserted %d of %d articles, failed %v", result.Inserted, len(articles), result.Failed)
+	}
+}
+
+func ids(articles []*Article) []string {
+	var res = make([]string, len(articles))
+
+	for i, a := range articles {
+		res[i] = a.Id
+	}
+
+	return res
+}
+
+func equalIds(got []string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func testReadBatch(t *testing.T, s ArticleStore) {
+	fill(t, s, testArticle("a", "A"), testArticle("b", "B"), testArticle("c", "C"))
+
+	var tests = []struct {
+		skip, take int
+		want       []string
+	}{
+		{0, 10, []string{"a", "b", "c"}},
+		{0, 2, []string{"a", "b"}},
+		{1, 1, []string{"b"}},
+		{3, 10, nil},
+	}
+
+	for _, test := range tests {
+		var batch, err = s.ReadBatch(test.skip, test.take)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !equalIds(ids(batch), test.want...) {
+			t.Errorf("ReadBatch(%d, %d) = %q, want %q", test.skip, test.take, ids(batch), test.want)
+		}
+	}
+
+	if batch, _ := s.ReadBatch(1, 1); len(batch) == 1 && batch[0].Title != "B" {
+		t.Errorf("ReadBatch read title %q, want B", batch[0].Title)
+	}
+}
+
+func testReadOldBatch(t *testing.T, s ArticleStore) {
+	fill(t, s, withSite(testArticle("a", "A"), "a"), testArticle("b", "B"), withSite(testArticle("c", "C"), "c"))
+
+	var tests = []struct {
+		skip, take int
+		want       []string
+	}{
+		{0, 10, []string{"a", "c"}},
+		{1, 10, []string{"c"}},
+		{0, 1, []string{"a"}},
+	}
+
+	for _, test := range tests {
+		var batch, err = s.ReadOldBatch(test.skip, test.take)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !equalIds(ids(batch), test.want...) {
+			t.Errorf("ReadOldBatch(%d, %d) = %q, want %q", test.skip, test.take, ids(batch), test.want)
+		}
+	}
+}
+
+func testUpdateBatch(t *testing.T, s ArticleStore) {
+	fill(t, s, testArticle("a", "A"), testArticle("b", "B"))
+
+	var changed = testArticle("a", "A2")
+	var result, err = s.UpdateBatch([]*Article{changed, testArticle("b", "B"), testArticle("c", "C")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Matched != 2 || result.Inserted != 1 || len(result.Failed) != 0 {
+		t.Errorf("UpdateBatch matched %d, inserted %d, failed %v, want 2, 1, none",
+			result.Matched, result.Inserted, result.Failed)
+	}
+
+	batch, err := s.ReadBatch(0, 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !equalIds(ids(batch), "a", "b", "c") {
+		t.Fatalf("stored %q, want a, b, c", ids(batch))
+	}
+
+	if batch[0].Title != "A2" {
+		t.Errorf("UpdateBatch left title %q, want A2", batch[0].Title)
+	}
+
+	if c := batch[2]; c.FirstSeen.IsZero() || c.Schema != currentSchema() {
+		t.Errorf("UpdateBatch inserted first seen %v, schema %d, want now and %d", c.FirstSeen, c.Schema, currentSchema())
+	}
+}
+
+func testUpdateWebsiteBatch(t *testing.T, s ArticleStore) {
+	fill(t, s, withSite(testArticle("a", "A"), "site"), testArticle("b", "B"))
+
+	var page = testArticle("a", "changed title")
+	page.WebsiteRaw = []byte("page")
+
+	var result, err = s.UpdateWebsiteBatch([]*Article{page, testArticle("x", "X")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Matched != 1 || result.Modified != 1 || result.Failed["x"] != ErrNotFound {
+		t.Errorf("UpdateWebsiteBatch matched %d, modified %d, failed %v, want 1, 1, x not found",
+			result.Matched, result.Modified, result.Failed)
+	}
+
+	batch, err := s.ReadBatch(0, 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !equalIds(ids(batch), "a", "b") {
+		t.Fatalf("stored %q, want a, b", ids(batch))
+	}
+
+	var a = batch[0]
+
+	if string(a.WebsiteRaw) != "page" || a.SiteData != nil {
+		t.Errorf("UpdateWebsiteBatch stored page %q and site %v, want page and no site", a.WebsiteRaw, a.SiteData)
+	}
+
+	if a.Title != "A" {
+		t.Errorf("UpdateWebsiteBatch changed the title to %q", a.Title)
+	}
+
+	if old, _ := s.ReadOldBatch(0, 10); len(old) != 0 {
+		t.Errorf("ReadOldBatch after removing the site = %q, want none", ids(old))
+	}
+}
+
+func testUpdateColdBatch(t *testing.T, s ArticleStore) {
+	var a = withSite(testArticle("a", "A"), "site")
+	a.WebsiteRaw = []byte("page")
+	fill(t, s, a, testArticle("b", "B"))
+
+	var cold = testArticle("a", "changed title")
+	cold.Text = "text"
+	cold.Cold = &ColdPage{File: "2013-05.warc.gz", Offset: 10, Length: 20}
+
+	var result, err = s.UpdateColdBatch([]*Article{cold, testArticle("x", "X")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Matched != 1 || result.Modified != 1 || result.Failed["x"] != ErrNotFound {
+		t.Errorf("UpdateColdBatch matched %d, modified %d, failed %v, want 1, 1, x not found",
+			result.Matched, result.Modified, result.Failed)
+	}
+
+	batch, err := s.ReadBatch(0, 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !equalIds(ids(batch), "a", "b") {
+		t.Fatalf("stored %q, want a, b", ids(batch))
+	}
+
+	a = batch[0]
+
+	if a.WebsiteRaw != nil || a.SiteData != nil {
+		t.Errorf("UpdateColdBatch kept page %q and site %v", a.WebsiteRaw, a.SiteData)
+	}
+
+	if a.Text != "text" || a.Cold == nil || *a.Cold != *cold.Cold {
+		t.Errorf("UpdateColdBatch stored text %q and cold page %v", a.Text, a.Cold)
+	}
+
+	if a.Title != "A" {
+		t.Errorf("UpdateColdBatch changed the title to %q", a.Title)
+	}
+}
+
+func testNewIds(t *testing.T, s ArticleStore) {
+	fill(t, s, testArticle("a", "A"), testArticle("b", "B"))
+
+	var tests = []struct {
+		ids  []string
+		want []string
+	}{
+		{[]string{"c", "a", "d", "b"}, []string{"c", "d"}},
+		{[]string{"a", "b"}, nil},
+		{[]string{"e"}, []string{"e"}},
+		{nil, nil},
+	}
+
+	for _, test := range tests {
+		var got, err = s.NewIds(test.ids)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !equalIds(got, test.want...) {
+			t.Errorf("NewIds(%q) = %q, want %q", test.ids, got, test.want)
+		}
+	}
+}
+
+func testArticles(t *testing.T, s ArticleStore) {
+	fill(t, s, testArticle("a", "A"), withSite(testArticle("b", "B"), "b"))
+
+	var iter = s.Articles()
+	var got []*Article
+
+	for a := new(Article); iter.Next(a); a = new(Article) {
+		got = append(got, a)
+	}
+
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !equalIds(ids(got), "a", "b") {
+		t.Fatalf("Articles = %q, want a, b", ids(got))
+	}
+
+	if got[0].Title != "A" || got[1].SiteData == nil || string(got[1].SiteData.Data) != "b" {
+		t.Errorf("Articles read %+v", got)
+	}
+}
+
+func testUpdate(t *testing.T, s ArticleStore) {
+	fill(t, s, testArticle("a", "A"))
+
+	if err := s.Update(testArticle("x", "X")); err != ErrNotFound {
+		t.Errorf("Update of a missing article = %v, want ErrNotFound", err)
+	}
+
+	var a = testArticle("a", "A2")
+	a.Summary = "summary"
+
+	if err := s.Update(a); err != nil {
+		t.Fatal(err)
+	}
+
+	var batch, err = s.ReadBatch(0, 10)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !equalIds(ids(batch), "a") {
+		t.Fatalf("stored %q, want a", ids(batch))
+	}
+
+	if batch[0].Title != "A2" || batch[0].Summary != "summary" {
+		t.Errorf("Update stored %q %q, want A2 summary", batch[0].Title, batch[0].Summary)
+	}
+}
+
+// testCopies checks that changing the articles written or read does not
+// change what is stored.
+func testCopies(t *testing.T, s ArticleStore) {
+	var a = withSite(testArticle("a", "A"), "site")
+	a.Categories = []string{"news"}
+	a.Media = []Media{{Url: "http://example.com/a.jpg"}}
+
+	fill(t, s, a)
+
+	a.Categories[0] = "written"
+	a.Media[0].Url = "written"
+	a.SiteData.Data[0] = 'x'
+
+	var batch, err = s.ReadBatch(0, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	batch[0].Categories[0] = "read"
+	batch[0].SiteData.Data[0] = 'y'
+
+	if batch, err = s.ReadBatch(0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored = batch[0]
+
+	if stored.Categories[0] != "news" || stored.Media[0].Url != "http://example.com/a.jpg" || string(stored.SiteData.Data) != "site" {
+		t.Errorf("stored article changed to %q %q %q", stored.Categories, stored.Media[0].Url, stored.SiteData.Data)
+	}
+}
+
+// testBlobs makes a FileBlobStore in a temporary directory the shared blob
+// store.
+func testBlobs(t *testing.T) (*FileBlobStore, func()) {
+	var dir, err = ioutil.TempDir("", "blobs")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenFileBlobStore(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobsMutex.Lock()
+	blobs = s
+	blobsMutex.Unlock()
+
+	return s, func() {
+		closeBlobs()
+		os.RemoveAll(dir)
+	}
+}
+
+func testBlobRefs(t *testing.T, s ArticleStore) {
+	var b, done = testBlobs(t)
+	defer done()
+
+	var hashes []string
+
+	for _, page := range []string{"one", "two"} {
+		var hash = PageHash([]byte(page))
+
+		if _, err := b.Put(hash, []byte(page)); err != nil {
+			t.Fatal(err)
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	var a = testArticle("a", "A")
+	a.WebsiteHash = hashes[0]
+	fill(t, s, a)
+
+	if b.refs[hashes[0]] != 2 {
+		t.Errorf("inserting a page in a blob left %d references, want 2", b.refs[hashes[0]])
+	}
+
+	a = testArticle("a", "A2")
+	a.WebsiteHash = hashes[0]
+
+	if _, err := s.UpdateBatch([]*Article{a}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.refs[hashes[0]] != 2 {
+		t.Errorf("rewriting the same page left %d references, want 2", b.refs[hashes[0]])
+	}
+
+	a.WebsiteHash = hashes[1]
+
+	if _, err := s.UpdateWebsiteBatch([]*Article{a}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.refs[hashes[0]] != 1 || b.refs[hashes[1]] != 1 {
+		t.Errorf("UpdateWebsiteBatch left %d and %d references, want 1 and 1", b.refs[hashes[0]], b.refs[hashes[1]])
+	}
+
+	a.WebsiteHash = hashes[0]
+
+	if _, err := s.UpdateBatch([]*Article{a}); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.refs[hashes[0]] != 2 || b.refs[hashes[1]] != 0 {
+		t.Errorf("UpdateBatch left %d and %d references, want 2 and 0", b.refs[hashes[0]], b.refs[hashes[1]])
+	}
+
+	a.WebsiteHash, a.WebsiteRaw = "", []byte("inline")
+
+	if err := s.Update(a); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.refs[hashes[0]] != 1 {
+		t.Errorf("Update left %d references to the replaced blob, want 1", b.refs[hashes[0]])
+	}
+}
+
+func TestFileStoreCompact(t *testing.T) {
+	var dir, err = ioutil.TempDir("", "filestore")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	s, err := OpenFileStore(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fill(t, s, testArticle("a", "A"), testArticle("b", "B"))
+
+	for _, title := range []string{"A2", "A3"} {
+		if err := s.Update(testArticle("a", title)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var before = s.index.Size
+
+	if s.index.Garbage == 0 {
+		t.Error("no garbage recorded for the replaced records")
+	}
+
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.index.Garbage != 0 || s.index.Size >= before {
+		t.Errorf("compacted log has %d bytes and %d garbage, had %d", s.index.Size, s.index.Garbage, before)
+	}
+
+	if err := s.Update(testArticle("b", "B2")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err = OpenFileStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	var batch, _ = s.ReadBatch(0, 10)
+
+	if !equalIds(ids(batch), "a", "b") || batch[0].Title != "A3" || batch[1].Title != "B2" {
+		t.Errorf("reopened compacted store holds %+v", batch)
+	}
+}
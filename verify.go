@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/md5"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+)
+
+// The kinds of problems verify looks for.
+const (
+	problemPage    = "page"
+	problemSite    = "site"
+	problemBlob    = "blob"
+	problemCold    = "cold"
+	problemId      = "id"
+	problemBoth    = "both"
+	problemPubDate = "pubDate"
+	problemTitle   = "title"
+)
+
+// Problem is something wrong with a stored article.
+type Problem struct {
+	Kind   string
+	Detail string
+}
+
+func (p *Problem) String() string {
+	if p.Detail == "" {
+		return p.Kind
+	}
+
+	return p.Kind + ": " + p.Detail
+}
+
+// readAll reads reader to the end and closes it.
+func readAll(reader io.ReadCloser, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+// VerifyArticle reads every page of a and checks that its id is the md5 of
+// its link, that it keeps SiteData only without another page and that it
+// has a title and a publication date.
+func VerifyArticle(a *Article) []*Problem {
+	var problems []*Problem
+	var add = func(kind string, detail string) {
+		problems = append(problems, &Problem{kind, detail})
+	}
+
+	if a.WebsiteRaw != nil {
+		if _, err := readAll(Decompress(a.WebsiteRaw)); err != nil {
+			add(problemPage, err.Error())
+		}
+	}
+
+	if a.SiteData != nil {
+		if _, err := readAll(a.Site()); err != nil && err != ErrNoData {
+			add(problemSite, err.Error())
+		}
+	}
+
+	if a.WebsiteHash != "" {
+		var data, err = LoadBlob(a.WebsiteHash)
+		var page []byte
+
+		if err == nil {
+			page, err = readAll(Decompress(data))
+		}
+
+		if err != nil {
+			add(problemBlob, err.Error())
+		} else if PageHash(page) != a.WebsiteHash {
+			add(problemBlob, "content does not match "+a.WebsiteHash)
+		}
+	}
+
+	if a.Cold != nil {
+		if _, err := readAll(LoadColdPage(a.Cold)); err != nil {
+			add(problemCold, err.Error())
+		}
+	}
+
+	var h = md5.New()
+	io.WriteString(h, a.Link)
+
+	if string(h.Sum(nil)) != a.Id {
+		add(problemId, fmt.Sprintf("%x is not the md5 of %s", a.Id, a.Link))
+	}
+
+	if a.SiteData != nil {
+		var others []string
+
+		if a.WebsiteRaw != nil {
+			others = append(others, "WebsiteRaw")
+		}
+
+		if a.WebsiteHash != "" {
+			others = append(others, "WebsiteHash")
+		}
+
+		if a.Cold != nil {
+			others = append(others, "Cold")
+		}
+
+		if len(others) > 0 {
+			add(problemBoth, "SiteData and "+strings.Join(others, ", "))
+		}
+	}
+
+	if a.PubDate.IsZero() {
+		add(problemPubDate, "zero")
+	}
+
+	if strings.TrimSpace(a.Title) == "" {
+		add(problemTitle, "empty")
+	}
+
+	return problems
+}
+
+// RepairArticle fixes the problems of a that can be fixed and returns the
+// others. An unreadable WebsiteRaw is replaced with a readable SiteData,
+// SiteData is dropped next to another page that is readable and a missing
+// PubDate is taken from FirstSeen.
+func RepairArticle(a *Article, problems []*Problem) []*Problem {
+	var kinds = make(map[string]bool)
+
+	for _, p := range problems {
+		kinds[p.Kind] = true
+	}
+
+	var fixed = make(map[string]bool)
+
+	if kinds[problemPage] && a.SiteData != nil && !kinds[problemSite] {
+		var site, err = a.Site()
+
+		if err == nil {
+			err = a.SetWebsite(site)
+			site.Close()
+		}
+
+		if err == nil {
+			a.SiteData = nil
+			fixed[problemPage], fixed[problemBoth] = true, true
+		}
+	}
+
+	if kinds[problemBoth] && !kinds[problemPage] && !kinds[problemBlob] && !kinds[problemCold] {
+		a.SiteData = nil
+		fixed[problemBoth] = true
+	}
+
+	if kinds[problemPubDate] && !a.FirstSeen.IsZero() {
+		a.PubDate = a.FirstSeen
+		fixed[problemPubDate] = true
+	}
+
+	var left []*Problem
+
+	for _, p := range problems {
+		if !fixed[p.Kind] {
+			left = append(left, p)
+		}
+	}
+
+	return left
+}
+
+// VerifyReport counts the problems verify found in a source by kind.
+type VerifyReport struct {
+	Source      string
+	Read        int
+	Problems    map[string]int
+	Repaired    int
+	Quarantined int
+}
+
+func (r *VerifyReport) String() string {
+	var kinds []string
+
+	for kind, n := range r.Problems {
+		kinds = append(kinds, fmt.Sprintf("%s %d", kind, n))
+	}
+
+	sort.Strings(kinds)
+
+	return fmt.Sprintf("%s: %d read, problems: %s, %d repaired, %d quarantined",
+		r.Source, r.Read, strings.Join(kinds, ", "), r.Repaired, r.Quarantined)
+}
+
+// verify checks the articles of sources, by default all that are crawled,
+// and optionally repairs or quarantines those with problems.
+func verify(args []string) {
+	var flags = flag.NewFlagSet("verify", flag.ExitOnError)
+	var repair = flags.Bool("repair", false, "fix the problems that can be fixed")
+	var quarantine = flags.Bool("quarantine", false, "leave articles with problems out of queries")
+	var restart = flags.Bool("restart", false, "start again with the first article instead of the checkpoint")
+
+	flags.Parse(args)
+
+	var names = flags.Args()
+
+	if len(names) == 0 {
+		for name := range sourceFeeds {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+	}
+
+	for _, name := range names {
+		var report, err = Verify(name, *repair, *quarantine, *restart)
+
+		if err != nil {
+			log.Fatal(name, ": ", err)
+		}
+
+		log.Println(report)
+	}
+}
+
+// Verify checks every article of a source and logs its problems. With
+// repair, it fixes what it can, with quarantine, articles with problems
+// left are marked with them in Quarantine. Either way, articles found
+// without problems leave the quarantine.
+func Verify(name string, repair, quarantine, restart bool) (*VerifyReport, error) {
+	var store, err = OpenStore(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	batches, err := NewBatchIterator(store, "verify", AllArticles, batchSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if restart {
+		if err := batches.Restart(); err != nil {
+			return nil, err
+		}
+	}
+
+	var report = &VerifyReport{Source: name, Problems: make(map[string]int)}
+
+	for {
+		var batch, err = batches.Next()
+
+		if err != nil {
+			return report, err
+		}
+
+		if len(batch) == 0 {
+			break
+		}
+
+		var changed []*Article
+
+		for _, a := range batch {
+			report.Read++
+
+			var problems = VerifyArticle(a)
+
+			for _, p := range problems {
+				report.Problems[p.Kind]++
+				log.Printf("%s %x %s", name, a.Id, p)
+			}
+
+			// Without flags, only articles found without problems change:
+			// they leave the quarantine.
+			if !repair && !quarantine && (len(problems) > 0 || a.Quarantine == "") {
+				continue
+			}
+
+			var left = problems
+
+			if repair && len(problems) > 0 {
+				left = RepairArticle(a, problems)
+			}
+
+			var reasons []string
+
+			for _, p := range left {
+				reasons = append(reasons, p.Kind)
+			}
+
+			var mark = a.Quarantine
+
+			if quarantine && len(left) > 0 || a.Quarantine != "" {
+				mark = strings.Join(reasons, ",")
+			}
+
+			if len(left) == len(problems) && mark == a.Quarantine {
+				continue
+			}
+
+			if len(left) < len(problems) {
+				report.Repaired++
+			}
+
+			if mark != "" && a.Quarantine == "" {
+				report.Quarantined++
+			}
+
+			a.Quarantine = mark
+			changed = append(changed, a)
+		}
+
+		var result *BatchResult
+
+		if len(changed) > 0 {
+			if result, err = store.UpdateBatch(changed); err != nil {
+				return report, err
+			}
+
+			logFailed(result)
+		}
+
+		if err := batches.Commit(result); err != nil {
+			return report, err
+		}
+	}
+
+	return report, batches.Restart()
+}
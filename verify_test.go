@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sound returns an article VerifyArticle finds no problems with.
+func sound(link string) *Article {
+	var h = md5.New()
+	io.WriteString(h, link)
+
+	return &Article{
+		Id:        string(h.Sum(nil)),
+		Link:      link,
+		Title:     "Title",
+		PubDate:   time.Date(2013, 5, 1, 12, 0, 0, 0, time.UTC),
+		FirstSeen: time.Date(2013, 5, 1, 13, 0, 0, 0, time.UTC),
+	}
+}
+
+func compressed(t *testing.T, page string) []byte {
+	var data, err = Compress(strings.NewReader(page), nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func problemKinds(problems []*Problem) string {
+	var kinds []string
+
+	for _, p := range problems {
+		kinds = append(kinds, p.Kind)
+	}
+
+	return strings.Join(kinds, ",")
+}
+
+func TestVerifyArticle(t *testing.T) {
+	var b, done = testBlobs(t)
+	defer done()
+
+	var hash = PageHash([]byte("page"))
+
+	if _, err := b.Put(hash, compressed(t, "page")); err != nil {
+		t.Fatal(err)
+	}
+
+	var otherHash = PageHash([]byte("other"))
+
+	if _, err := b.Put(otherHash, compressed(t, "page")); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name   string
+		change func(a *Article)
+		want   string
+	}{
+		{"sound", func(a *Article) {}, ""},
+		{"page", func(a *Article) { a.WebsiteRaw = compressed(t, "page")[:3] }, "page"},
+		{"site", func(a *Article) { withSite(a, "!!").SiteData.Compressed = true }, "site"},
+		{"blob", func(a *Article) { a.WebsiteHash = PageHash([]byte("missing")) }, "blob"},
+		{"blob content", func(a *Article) { a.WebsiteHash = otherHash }, "blob"},
+		{"cold", func(a *Article) { a.Cold = &ColdPage{File: "missing.warc"} }, "cold"},
+		{"id", func(a *Article) { a.Link += "?moved" }, "id"},
+		{"both raw", func(a *Article) { withSite(a, "site").WebsiteRaw = compressed(t, "page") }, "both"},
+		{"both blob", func(a *Article) { withSite(a, "site").WebsiteHash = hash }, "both"},
+		{"pubDate", func(a *Article) { a.PubDate = time.Time{} }, "pubDate"},
+		{"title", func(a *Article) { a.Title = " " }, "title"},
+		{"several", func(a *Article) { a.Title, a.WebsiteRaw = "", []byte("x") }, "page,title"},
+	}
+
+	for _, test := range tests {
+		var a = sound("http://example.com/" + test.name)
+		test.change(a)
+
+		if got := problemKinds(VerifyArticle(a)); got != test.want {
+			t.Errorf("%s: problems %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRepairArticle(t *testing.T) {
+	var tests = []struct {
+		name   string
+		change func(a *Article)
+		left   string
+		check  func(a *Article) bool
+	}{
+		{
+			"page from site",
+			func(a *Article) { withSite(a, "site").WebsiteRaw = []byte("x") },
+			"",
+			func(a *Article) bool {
+				var page, err = articlePage(a)
+				return err == nil && string(page) == "site" && a.SiteData == nil
+			},
+		},
+		{
+			"page without site",
+			func(a *Article) { a.WebsiteRaw = []byte("x") },
+			"page",
+			func(a *Article) bool { return bytes.Equal(a.WebsiteRaw, []byte("x")) },
+		},
+		{
+			"page with broken site",
+			func(a *Article) { withSite(a, "!!").SiteData.Compressed = true; a.WebsiteRaw = []byte("x") },
+			"page,site,both",
+			func(a *Article) bool { return a.SiteData != nil },
+		},
+		{
+			"both",
+			func(a *Article) { withSite(a, "site").WebsiteRaw = compressed(t, "page") },
+			"",
+			func(a *Article) bool {
+				var page, err = articlePage(a)
+				return err == nil && string(page) == "page" && a.SiteData == nil
+			},
+		},
+		{
+			"both with cold problem",
+			func(a *Article) { withSite(a, "site").Cold = &ColdPage{File: "missing.warc"} },
+			"cold,both",
+			func(a *Article) bool { return a.SiteData != nil },
+		},
+		{
+			"pubDate",
+			func(a *Article) { a.PubDate = time.Time{} },
+			"",
+			func(a *Article) bool { return a.PubDate.Equal(a.FirstSeen) },
+		},
+		{
+			"pubDate without firstSeen",
+			func(a *Article) { a.PubDate, a.FirstSeen = time.Time{}, time.Time{} },
+			"pubDate",
+			func(a *Article) bool { return a.PubDate.IsZero() },
+		},
+		{
+			"id",
+			func(a *Article) { a.Link += "?moved" },
+			"id",
+			func(a *Article) bool { return true },
+		},
+	}
+
+	for _, test := range tests {
+		var a = sound("http://example.com/" + test.name)
+		test.change(a)
+
+		var left = problemKinds(RepairArticle(a, VerifyArticle(a)))
+
+		if left != test.left {
+			t.Errorf("%s: left %q, want %q", test.name, left, test.left)
+		}
+
+		if !test.check(a) {
+			t.Errorf("%s: repaired to %+v", test.name, a)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	defer testStoreDir(t)()
+
+	var store, err = OpenStore("verifytest")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fixed, broken, repairable = sound("http://example.com/fixed"), sound("http://example.com/broken"), sound("http://example.com/repairable")
+	fixed.Quarantine = "title"
+	broken.Title = ""
+	repairable.PubDate = time.Time{}
+	fill(t, store, fixed, broken, repairable)
+
+	var read = func() map[string]*Article {
+		var batch, err = store.ReadBatch(0, 10)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var articles = make(map[string]*Article)
+
+		for _, a := range batch {
+			articles[a.Link] = a
+		}
+
+		return articles
+	}
+
+	// Without flags only the quarantine of articles without problems is
+	// lifted.
+	if _, err := Verify("verifytest", false, false, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var articles = read()
+
+	if a := articles[fixed.Link]; a.Quarantine != "" {
+		t.Errorf("fixed article kept quarantine %q", a.Quarantine)
+	}
+
+	if a := articles[broken.Link]; a.Quarantine != "" {
+		t.Errorf("broken article quarantined without -quarantine: %q", a.Quarantine)
+	}
+
+	report, err := Verify("verifytest", true, true, true)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Read != 3 || report.Repaired != 1 || report.Quarantined != 1 || report.Problems[problemTitle] != 1 || report.Problems[problemPubDate] != 1 {
+		t.Errorf("report %v", report)
+	}
+
+	articles = read()
+
+	if a := articles[broken.Link]; a.Quarantine != problemTitle {
+		t.Errorf("broken article quarantined for %q, want %q", a.Quarantine, problemTitle)
+	}
+
+	if a := articles[repairable.Link]; a.Quarantine != "" || !a.PubDate.Equal(a.FirstSeen) {
+		t.Errorf("repaired article quarantined for %q, published %v", a.Quarantine, a.PubDate)
+	}
+}
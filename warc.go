@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WarcWriter writes pages as WARC 1.0 request and response records. The
+// original response headers are not stored, so the responses are written
+// with a plain 200 status and the html content type.
+type WarcWriter struct {
+	writer io.Writer
+	// Compress writes every record as a gzip member, as in .warc.gz files.
+	Compress bool
+}
+
+func NewWarcWriter(writer io.Writer, compress bool) *WarcWriter {
+	return &WarcWriter{writer, compress}
+}
+
+// WriteInfo writes the warcinfo record that starts a file.
+func (w *WarcWriter) WriteInfo(filename string) error {
+	var fields = "software: go-paper\r\nformat: WARC File Format 1.0\r\n"
+
+	return w.record([]string{
+		"WARC-Type: warcinfo",
+		"WARC-Record-ID: " + warcRecordId(),
+		"WARC-Date: " + warcDate(time.Now()),
+		"WARC-Filename: " + filename,
+		"Content-Type: application/warc-fields",
+	}, []byte(fields))
+}
+
+// WriteArticle writes a request for the link of a and the response with
+// page. The id and source of a are kept in the WARC-Paper-Id, hex encoded,
+// and WARC-Paper-Source headers.
+func (w *WarcWriter) WriteArticle(a *Article, page []byte) error {
+	var link, err = url.Parse(a.Link)
+
+	if err != nil {
+		return err
+	}
+
+	var date = a.FirstSeen
+
+	if date.IsZero() {
+		date = a.PubDate
+	}
+
+	var requestId, responseId = warcRecordId(), warcRecordId()
+
+	var request = fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", link.RequestURI(), link.Host)
+	var response = new(bytes.Buffer)
+
+	fmt.Fprintf(response, "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: %d\r\n\r\n", len(page))
+	response.Write(page)
+
+	var digest = sha1.New()
+	digest.Write(page)
+
+	var headers = []string{
+		"WARC-Type: response",
+		"WARC-Record-ID: " + responseId,
+		"WARC-Date: " + warcDate(date),
+		"WARC-Target-URI: " + a.Link,
+		"WARC-Payload-Digest: sha1:" + base32.StdEncoding.EncodeToString(digest.Sum(nil)),
+		"WARC-Paper-Id: " + hex.EncodeToString([]byte(a.Id)),
+		"Content-Type: application/http; msgtype=response",
+	}
+
+	if a.Source != "" {
+		headers = append(headers, "WARC-Paper-Source: "+a.Source)
+	}
+
+	if err := w.record(headers, response.Bytes()); err != nil {
+		return err
+	}
+
+	return w.record([]string{
+		"WARC-Type: request",
+		"WARC-Record-ID: " + requestId,
+		"WARC-Date: " + warcDate(date),
+		"WARC-Target-URI: " + a.Link,
+		"WARC-Concurrent-To: " + responseId,
+		"Content-Type: application/http; msgtype=request",
+	}, []byte(request))
+}
+
+func (w *WarcWriter) record(headers []string, block []byte) error {
+	var buffer = new(bytes.Buffer)
+
+	buffer.WriteString("WARC/1.0\r\n")
+
+	for _, h := range headers {
+		buffer.WriteString(h + "\r\n")
+	}
+
+	fmt.Fprintf(buffer, "Content-Length: %d\r\n\r\n", len(block))
+	buffer.Write(block)
+	buffer.WriteString("\r\n\r\n")
+
+	if !w.Compress {
+		var _, err = w.writer.Write(buffer.Bytes())
+		return err
+	}
+
+	var writer = gzip.NewWriter(w.writer)
+
+	if _, err := writer.Write(buffer.Bytes()); err != nil {
+		return err
+	}
+
+	return writer.Close()
+}
+
+func warcRecordId() string {
+	var b = make([]byte, 16)
+	io.ReadFull(rand.Reader, b)
+
+	// A version 4 uuid.
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func warcDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// WarcRecord is a record read by WarcReader.
+type WarcRecord struct {
+	Headers http.Header
+	Block   []byte
+}
+
+// Page returns the body of a response record.
+func (r *WarcRecord) Page() ([]byte, error) {
+	if r.Headers.Get("WARC-Type") != "response" {
+		return nil, errors.New("Not a response record")
+	}
+
+	var response, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(r.Block)), nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	return ioutil.ReadAll(response.Body)
+}
+
+// WarcReader reads the records of a WARC file, compressed or not.
+type WarcReader struct {
+	reader *bufio.Reader
+}
+
+func NewWarcReader(reader io.Reader) (*WarcReader, error) {
+	var buffered = bufio.NewReader(reader)
+	var magic, err = buffered.Peek(2)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		var unzipped, err = gzip.NewReader(buffered)
+
+		if err != nil {
+			return nil, err
+		}
+
+		buffered = bufio.NewReader(unzipped)
+	}
+
+	return &WarcReader{buffered}, nil
+}
+
+// Next returns the next record, or io.EOF after the last one.
+func (r *WarcReader) Next() (*WarcRecord, error) {
+	var version, err = r.line()
+
+	for err == nil && version == "" {
+		version, err = r.line()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, fmt.Errorf("Expected a WARC record, got %q", version)
+	}
+
+	var record = &WarcRecord{Headers: make(http.Header)}
+
+	for {
+		var line, err = r.line()
+
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		if line == "" {
+			break
+		}
+
+		var parts = strings.SplitN(line, ":", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid WARC header %q", line)
+		}
+
+		record.Headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	length, err := strconv.Atoi(record.Headers.Get("Content-Length"))
+
+	if err != nil {
+		return nil, errors.New("WARC record without Content-Length")
+	}
+
+	record.Block = make([]byte, length)
+
+	if _, err := io.ReadFull(r.reader, record.Block); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return record, nil
+}
+
+// line reads a line without its line ending.
+func (r *WarcReader) line() (string, error) {
+	var line, err = r.reader.ReadString('\n')
+
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+
+	return strings.TrimRight(line, "\r\n"), err
+}
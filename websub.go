@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var signatureHashes = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// A subscription is considered pending for this long after the request to
+// the hub. The request is repeated if the hub does not verify it in time.
+const pendingTimeout = 10 * time.Minute
+
+// Subscriber subscribes to the WebSub hubs feeds advertise and passes the
+// entries the hubs push through the same conversion as Fetch.
+type Subscriber struct {
+	// Callback is the public url the Subscriber is served at.
+	Callback string
+	// Secret signs the pushed content, leave it empty to skip validation.
+	Secret string
+	Lease  time.Duration
+	Client *http.Client
+
+	mutex         sync.Mutex
+	subscriptions map[string]*subscription
+}
+
+type subscription struct {
+	hub      string
+	topic    string
+	fetch    *Fetch
+	verified bool
+	// renew is the time after which the subscription is requested again.
+	renew time.Time
+}
+
+func NewSubscriber(callback, secret string, lease time.Duration) *Subscriber {
+	return &Subscriber{
+		Callback:      callback,
+		Secret:        secret,
+		Lease:         lease,
+		Client:        http.DefaultClient,
+		subscriptions: make(map[string]*subscription),
+	}
+}
+
+// Subscribe asks hub to push topic to the Subscriber, pushed items are
+// stored like the ones fetch reads. It does nothing if the subscription is
+// still active or pending, a subscription due for renewal stays verified
+// and keeps its fetch while the hub verifies it again.
+func (s *Subscriber) Subscribe(hub, topic string, fetch *Fetch) error {
+	s.mutex.Lock()
+	var sub, ok = s.subscriptions[topic]
+
+	if ok && sub.hub == hub {
+		if time.Now().Before(sub.renew) {
+			s.mutex.Unlock()
+			return nil
+		}
+
+		// A renewal keeps the subscription, the hub may push until it is
+		// verified again.
+		sub.renew = time.Now().Add(pendingTimeout)
+	} else {
+		sub = &subscription{
+			hub:   hub,
+			topic: topic,
+			fetch: fetch,
+			renew: time.Now().Add(pendingTimeout),
+		}
+		s.subscriptions[topic] = sub
+	}
+
+	s.mutex.Unlock()
+
+	var form = url.Values{
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {topic},
+		"hub.callback":      {s.callback(topic)},
+		"hub.lease_seconds": {strconv.Itoa(int(s.Lease / time.Second))},
+	}
+
+	if s.Secret != "" {
+		form.Set("hub.secret", s.Secret)
+	}
+
+	var response, err = s.Client.PostForm(hub, form)
+
+	if err != nil {
+		return err
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		return errors.New(hub + ": " + response.Status)
+	}
+
+	return nil
+}
+
+// callback returns the url the hub calls for topic.
+func (s *Subscriber) callback(topic string) string {
+	var separator = "?"
+
+	if strings.Contains(s.Callback, "?") {
+		separator = "&"
+	}
+
+	return s.Callback + separator + "topic=" + url.QueryEscape(topic)
+}
+
+func (s *Subscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		s.verify(w, r)
+	case "POST":
+		s.receive(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// verify answers the intent verification of a hub.
+func (s *Subscriber) verify(w http.ResponseWriter, r *http.Request) {
+	var query = r.URL.Query()
+	var topic = query.Get("hub.topic")
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var sub, ok = s.subscriptions[topic]
+
+	switch query.Get("hub.mode") {
+	case "subscribe":
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		var lease, _ = strconv.Atoi(query.Get("hub.lease_seconds"))
+
+		if lease <= 0 {
+			lease = int(s.Lease / time.Second)
+		}
+
+		// Renew after 90% of the lease has passed
+		sub.verified = true
+		sub.renew = time.Now().Add(time.Duration(lease) * time.Second * 9 / 10)
+		log.Println("Subscribed to", topic, "at", sub.hub, "for", lease, "seconds")
+	case "unsubscribe":
+		// Only confirm if we do not want the topic anymore
+		if ok {
+			http.NotFound(w, r)
+			return
+		}
+	case "denied":
+		log.Println("Subscription to", topic, "denied:", query.Get("hub.reason"))
+		delete(s.subscriptions, topic)
+		return
+	default:
+		http.Error(w, "Unknown hub.mode", http.StatusBadRequest)
+		return
+	}
+
+	w.Write([]byte(query.Get("hub.challenge")))
+}
+
+// receive handles content pushed by a hub.
+func (s *Subscriber) receive(w http.ResponseWriter, r *http.Request) {
+	var topic = r.URL.Query().Get("topic")
+
+	s.mutex.Lock()
+	var sub, ok = s.subscriptions[topic]
+	s.mutex.Unlock()
+
+	if !ok || !sub.verified {
+		http.NotFound(w, r)
+		return
+	}
+
+	var data, err = ioutil.ReadAll(r.Body)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s.Secret != "" && !validSignature(s.Secret, r.Header.Get("X-Hub-Signature"), data) {
+		// The hub must not learn about the failure, the content is dropped.
+		log.Println("Invalid signature for", topic)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	items, malformed, err := ParseFeedData(data)
+
+	if err != nil {
+		log.Println("Error parsing push for", topic, err)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if malformed {
+		log.Println("Recovered", len(items), "items from malformed push for", topic)
+	}
+
+	sub.fetch.store(items)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validSignature checks a X-Hub-Signature header like "sha1=<hex hmac>".
+func validSignature(secret, header string, data []byte) bool {
+	var parts = strings.SplitN(header, "=", 2)
+
+	if len(parts) != 2 {
+		return false
+	}
+
+	var newHash, ok = signatureHashes[parts[0]]
+
+	if !ok {
+		return false
+	}
+
+	var expected, err = hex.DecodeString(parts[1])
+
+	if err != nil {
+		return false
+	}
+
+	var mac = hmac.New(newHash, []byte(secret))
+	mac.Write(data)
+
+	return subtle.ConstantTimeCompare(mac.Sum(nil), expected) == 1
+}
+
+type feedLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type feedLinks struct {
+	Links   []feedLink `xml:"http://www.w3.org/2005/Atom link"`
+	Channel struct {
+		Links []feedLink `xml:"http://www.w3.org/2005/Atom link"`
+	} `xml:"channel"`
+}
+
+// FeedHub returns the hub a feed advertises and the topic url to subscribe
+// to, which is the self link if there is one. hub is empty if the feed has
+// no hub or cannot be decoded.
+func FeedHub(data []byte, url string) (hub, topic string) {
+	var doc feedLinks
+	var decoder = xml.NewDecoder(bytes.NewReader(data))
+
+	decoder.CharsetReader = charsetReader
+
+	if err := decoder.Decode(&doc); err != nil {
+		return "", ""
+	}
+
+	topic = url
+
+	for _, l := range append(doc.Links, doc.Channel.Links...) {
+		switch l.Rel {
+		case "hub":
+			hub = l.Href
+		case "self":
+			topic = l.Href
+		}
+	}
+
+	return hub, topic
+}
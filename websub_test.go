@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const pushedFeed = `<?xml version="1.0" encoding="utf-8"?>
+<rss version="2.0"><channel><title>Test</title>
+<item><title>Pushed</title><link>http://example.com/pushed</link><pubDate>Mon, 02 Jan 2006 15:04:05 GMT</pubDate></item>
+</channel></rss>`
+
+// testHub is a stand-in WebSub hub. It answers subscription requests and,
+// if verify is set, verifies the intent of the subscriber right away.
+type testHub struct {
+	verify bool
+
+	mutex     sync.Mutex
+	requests  []url.Values
+	challenge string
+	echoed    string
+	status    int
+}
+
+func (h *testHub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.requests = append(h.requests, r.Form)
+
+	if h.verify {
+		var query = url.Values{
+			"hub.mode":          {"subscribe"},
+			"hub.topic":         {r.Form.Get("hub.topic")},
+			"hub.challenge":     {h.challenge},
+			"hub.lease_seconds": {"3600"},
+		}
+
+		var response, err = http.Get(r.Form.Get("hub.callback") + "&" + query.Encode())
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var body, _ = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+
+		h.echoed, h.status = string(body), response.StatusCode
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// testSubscription serves a Subscriber with secret and subscribes it to
+// topic at a testHub that verifies the intent.
+func testSubscription(t *testing.T, secret string) (*Subscriber, *testHub, *MemorySink, func()) {
+	var s = NewSubscriber("", secret, time.Hour)
+	var callback = httptest.NewServer(s)
+	var hub = &testHub{verify: true, challenge: "challenge-1"}
+	var hubServer = httptest.NewServer(hub)
+	var sink = NewMemorySink()
+
+	s.Callback = callback.URL + "/push"
+
+	if err := s.Subscribe(hubServer.URL, "http://example.com/feed", NewFetch(nil, DefaultLink, sink)); err != nil {
+		t.Fatal(err)
+	}
+
+	return s, hub, sink, func() {
+		callback.Close()
+		hubServer.Close()
+	}
+}
+
+func push(t *testing.T, s *Subscriber, topic string, signature string) int {
+	var request, err = http.NewRequest("POST", s.callback(topic), bytes.NewReader([]byte(pushedFeed)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signature != "" {
+		request.Header.Set("X-Hub-Signature", signature)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	return response.StatusCode
+}
+
+func sign(secret string, data string) string {
+	var mac = hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(data))
+
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSubscribeVerifiesIntent(t *testing.T) {
+	var s, hub, _, done = testSubscription(t, "")
+	defer done()
+
+	if len(hub.requests) != 1 {
+		t.Fatalf("hub got %d requests, want 1", len(hub.requests))
+	}
+
+	var form = hub.requests[0]
+
+	if form.Get("hub.mode") != "subscribe" || form.Get("hub.topic") != "http://example.com/feed" {
+		t.Errorf("unexpected subscription request %v", form)
+	}
+
+	if hub.status != http.StatusOK || hub.echoed != hub.challenge {
+		t.Errorf("verification answered %d %q, want the challenge %q", hub.status, hub.echoed, hub.challenge)
+	}
+
+	if sub := s.subscriptions["http://example.com/feed"]; !sub.verified {
+		t.Error("subscription not verified")
+	}
+
+	var response, err = http.Get(s.callback("http://example.com/other") +
+		"&hub.mode=subscribe&hub.topic=http://example.com/other&hub.challenge=x")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("verification of unknown topic answered %d, want 404", response.StatusCode)
+	}
+}
+
+func TestPushSignature(t *testing.T) {
+	var s, _, sink, done = testSubscription(t, "secret")
+	defer done()
+
+	var tests = []struct {
+		signature string
+		stored    int
+	}{
+		{"", 0},
+		{sign("wrong", pushedFeed), 0},
+		{"md5=00", 0},
+		{sign("secret", pushedFeed), 1},
+	}
+
+	for _, test := range tests {
+		sink.Articles = nil
+
+		if status := push(t, s, "http://example.com/feed", test.signature); status != http.StatusNoContent {
+			t.Errorf("push signed %q answered %d, want 204", test.signature, status)
+		}
+
+		if len(sink.Articles) != test.stored {
+			t.Errorf("push signed %q stored %d articles, want %d", test.signature, len(sink.Articles), test.stored)
+		}
+	}
+}
+
+func TestPushReachesSink(t *testing.T) {
+	var s, _, sink, done = testSubscription(t, "")
+	defer done()
+
+	if status := push(t, s, "http://example.com/feed", ""); status != http.StatusNoContent {
+		t.Fatalf("push answered %d, want 204", status)
+	}
+
+	if len(sink.Articles) != 1 {
+		t.Fatalf("sink got %d articles, want 1", len(sink.Articles))
+	}
+
+	if a := sink.Articles[0]; a.Title != "Pushed" || a.Link != "http://example.com/pushed" {
+		t.Errorf("unexpected article %q %q", a.Title, a.Link)
+	}
+
+	if status := push(t, s, "http://example.com/unknown", ""); status != http.StatusNotFound {
+		t.Errorf("push of unknown topic answered %d, want 404", status)
+	}
+}
+
+func TestRenewalKeepsSubscription(t *testing.T) {
+	var s, hub, sink, done = testSubscription(t, "")
+	defer done()
+
+	var topic = "http://example.com/feed"
+	var sub = s.subscriptions[topic]
+	var hubUrl = sub.hub
+
+	sub.renew = time.Now().Add(-time.Second)
+	hub.verify = false
+
+	if err := s.Subscribe(hubUrl, topic, NewFetch(nil, DefaultLink, NewMemorySink())); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hub.requests) != 2 {
+		t.Fatalf("hub got %d requests, want 2", len(hub.requests))
+	}
+
+	if s.subscriptions[topic] != sub || !sub.verified {
+		t.Fatal("renewal replaced the verified subscription")
+	}
+
+	if !sub.renew.After(time.Now()) {
+		t.Error("renewal did not move the renewal time")
+	}
+
+	if push(t, s, topic, ""); len(sink.Articles) != 1 {
+		t.Errorf("push during renewal stored %d articles in the original sink, want 1", len(sink.Articles))
+	}
+}